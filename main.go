@@ -1,25 +1,64 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/textproto"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/user"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	_ "github.com/go-sql-driver/mysql" // MySQL driver
+	"github.com/go-sql-driver/mysql" // MySQL driver
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq" // PostgreSQL driver
+	"github.com/lib/pq" // PostgreSQL driver
 )
 
 // BackupConfig holds the configuration for the backup process
@@ -31,14 +70,98 @@ type BackupConfig struct {
 	DBUser     string
 	DBPassword string
 	Path       string
+
+	// DBSSLMode is the PostgreSQL sslmode (disable, require, verify-ca or
+	// verify-full), used for both the validation connection and pg_dump
+	DBSSLMode string
+
+	// Labels are free-form key/value pairs describing the job (env, team,
+	// ...). They are stored in the manifest, set as S3 object metadata and
+	// tags, and attached to the Prometheus metrics.
+	Labels map[string]string
+
 	S3Bucket   string
 	S3Region   string
 	S3Endpoint string
 	S3Prefix   string
+
+	// S3 credentials for this manager, filled by main from AWS_ACCESS_KEY_ID
+	// and AWS_SECRET_ACCESS_KEY
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+
+	// HTTP client settings for S3: an explicit proxy (otherwise HTTPS_PROXY
+	// applies), an extra CA bundle for private endpoints, a per-request
+	// timeout and the SDK retry behaviour
+	S3Proxy       string
+	S3CABundle    string
+	S3Timeout     time.Duration
+	S3RetryMode   string
+	S3MaxAttempts int
+
+	// FTP/FTPS destination, used instead of or alongside S3. FTPTLS is ""
+	// (plain FTP), "explicit" (AUTH TLS) or "implicit"; FTPActive switches
+	// from passive to active (PORT) data connections. FTPDir is a
+	// text/template rendered once per job with the host, connection,
+	// database and labels, so retention always lists the same directory.
+	FTPHost     string
+	FTPPort     string
+	FTPUser     string
+	FTPPassword string
+	FTPDir      string
+	FTPTLS      string
+	FTPActive   bool
+	FTPCABundle string
+	FTPInsecure bool
+	FTPTimeout  time.Duration
+
 	MaxFiles   int
 	Interval   time.Duration
+	Jitter     time.Duration
+	HostOffset bool
 	Gzip       bool
 	Optimize   bool
+
+	// Schema/data selection for SQL dumps. SplitSchema writes both as
+	// separate artifacts each cycle, retained under MaxSchemaFiles.
+	SchemaOnly     bool
+	DataOnly       bool
+	SplitSchema    bool
+	MaxSchemaFiles int
+
+	// PerTable dumps each table to its own file; Parallelism bounds how many
+	// files are dumped, compressed and uploaded at once
+	PerTable    bool
+	Parallelism int
+
+	// Client-side encryption. Each file gets a fresh data key, wrapped for
+	// every key in EncryptionKeys; RetiredKeys can still unwrap but are no
+	// longer used for new backups. Entries are "file:<path>" or "kms:<key-id>".
+	EncryptionKeys []string
+	RetiredKeys    []string
+	KMSRegion      string
+
+	// RestoreScript writes a restore script next to each backup, rendered
+	// from RestoreScriptTemplate or the built-in template
+	RestoreScript         bool
+	RestoreScriptTemplate string
+
+	// Audit trail of deletions and restores: AuditLog is an append-only
+	// JSON-lines file; AuditS3 also writes each event as an object under
+	// AuditS3Prefix, which is kept outside S3Prefix so audit objects never
+	// crowd the backup listing
+	AuditLog      string
+	AuditS3       bool
+	AuditS3Prefix string
+
+	// Offline skips the database connection, for commands that only work on
+	// stored backups
+	Offline bool
+
+	// Redis backup format: "rdb" (default), "aof" or "logical"
+	RedisFormat     string
+	RedisAOFPath    string
+	RedisKeyPattern string
 }
 
 // BackupManager handles the backup operations
@@ -46,6 +169,210 @@ type BackupManager struct {
 	config *BackupConfig
 	s3Svc  *s3.Client
 	db     *sqlx.DB
+	keys   *keyring
+
+	restoreTemplate *template.Template
+
+	// ftpDir is the rendered FTPDir; ftpTLS is set for FTPS
+	ftpDir string
+	ftpTLS *tls.Config
+
+	// auditFile is the open audit log, written under auditMu
+	auditFile *os.File
+	auditMu   sync.Mutex
+	actor     string
+
+	// manifestMu serialises read-modify-write cycles on the manifest
+	manifestMu sync.Mutex
+
+	// stats are this manager's counters, exported on /metrics with its labels
+	stats backupStats
+}
+
+// backupStats are a manager's runtime counters. They are the only copy: the
+// process-wide expvars are derived from them.
+type backupStats struct {
+	cycles       atomic.Int64
+	cyclesFailed atomic.Int64
+	bytes        atomic.Int64
+	inFlight     atomic.Int64
+	lastSuccess  atomic.Int64 // unix seconds
+	lastCycle    atomic.Int64 // nanoseconds
+	lastCycleEnd atomic.Int64 // unix nanoseconds
+}
+
+// manifestName is the manifest file kept next to the backups, locally and
+// under the S3 prefix
+const manifestName = "manifest.json"
+
+// Manifest lists the logical backups and the files that make up each one,
+// so a multi-file backup can be located and restored as a unit
+type Manifest struct {
+	Backups []ManifestBackup `json:"backups"`
+}
+
+// ManifestBackup is one logical backup, produced by a single cycle
+type ManifestBackup struct {
+	ID         string            `json:"id"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Connection string            `json:"connection"`
+	Database   string            `json:"database,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Files      []ManifestFile    `json:"files"`
+}
+
+// ManifestFile is a single file belonging to a logical backup
+type ManifestFile struct {
+	Name    string `json:"name"`
+	Part    string `json:"part,omitempty"`
+	Table   string `json:"table,omitempty"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	S3Key   string `json:"s3_key,omitempty"`
+	FTPPath string `json:"ftp_path,omitempty"`
+
+	// Encryption is an index copy of the file's key record; the record
+	// stored next to the file is authoritative
+	Encryption *FileEncryption `json:"encryption,omitempty"`
+}
+
+// FileEncryption records the data key of an encrypted file, wrapped once for
+// each key that may decrypt it. It is stored as JSON next to the file, in
+// <name>.keys, and uploaded before the file itself.
+type FileEncryption struct {
+	Algorithm string       `json:"algorithm"`
+	Keys      []WrappedKey `json:"keys"`
+}
+
+// WrappedKey is a data key encrypted under the key identified by KeyID
+type WrappedKey struct {
+	KeyID   string `json:"key_id"`
+	DataKey []byte `json:"data_key"`
+}
+
+// AuditEvent is one entry in the audit log
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Target  string    `json:"target"`
+	Trigger string    `json:"trigger"`
+	Detail  string    `json:"detail,omitempty"`
+	Actor   string    `json:"actor"`
+	PID     int       `json:"pid"`
+	Result  string    `json:"result"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Audit actions
+const (
+	AuditDeleteLocal    = "delete_local"
+	AuditDeleteS3       = "delete_s3"
+	AuditDeleteFTP      = "delete_ftp"
+	AuditRemoveUploaded = "remove_uploaded"
+	AuditRestore        = "restore"
+)
+
+// artifact is one file to produce during a backup cycle
+type artifact struct {
+	name  string // file name without the compression suffix
+	part  string // "", "schema", "data", "schema.pre-data" or "schema.post-data"
+	table string // set for per-table dumps
+}
+
+// allStats holds the stats of every BackupManager in the process, from which
+// the expvars on the diagnostics endpoint are computed
+var allStats struct {
+	sync.Mutex
+	list []*backupStats
+}
+
+func init() {
+	sum := func(field func(*backupStats) *atomic.Int64) expvar.Func {
+		return func() any {
+			var total int64
+			for _, s := range registeredStats() {
+				total += field(s).Load()
+			}
+			return total
+		}
+	}
+	expvar.Publish("backup_cycles_total", sum(func(s *backupStats) *atomic.Int64 { return &s.cycles }))
+	expvar.Publish("backup_cycles_failed_total", sum(func(s *backupStats) *atomic.Int64 { return &s.cyclesFailed }))
+	expvar.Publish("backup_bytes_total", sum(func(s *backupStats) *atomic.Int64 { return &s.bytes }))
+	expvar.Publish("backup_files_in_flight", sum(func(s *backupStats) *atomic.Int64 { return &s.inFlight }))
+	expvar.Publish("backup_last_success_unix", expvar.Func(func() any {
+		var last int64
+		for _, s := range registeredStats() {
+			last = max(last, s.lastSuccess.Load())
+		}
+		return last
+	}))
+	expvar.Publish("backup_last_cycle_seconds", expvar.Func(func() any {
+		// The duration of whichever manager finished a cycle most recently
+		var latest *backupStats
+		for _, s := range registeredStats() {
+			if latest == nil || s.lastCycleEnd.Load() > latest.lastCycleEnd.Load() {
+				latest = s
+			}
+		}
+		if latest == nil {
+			return 0.0
+		}
+		return time.Duration(latest.lastCycle.Load()).Seconds()
+	}))
+}
+
+// registeredStats returns a snapshot of allStats
+func registeredStats() []*backupStats {
+	allStats.Lock()
+	defer allStats.Unlock()
+	return slices.Clone(allStats.list)
+}
+
+// Errors returned by NewBackupManager and RunOnce wrap one of these sentinels,
+// so callers can use errors.Is to tell the failure stages apart
+var (
+	ErrDumpToolMissing = errors.New("dump tool missing")
+	ErrDBAuth          = errors.New("database authentication failed")
+	ErrUpload          = errors.New("upload failed")
+	ErrRetention       = errors.New("retention failed")
+	ErrVerification    = errors.New("verification failed")
+	ErrStorageConfig   = errors.New("storage misconfigured")
+)
+
+// Process exit codes used in -once mode. 2 is left to the flag package for
+// usage errors.
+const (
+	ExitOK              = 0
+	ExitFailure         = 1
+	ExitDumpToolMissing = 3
+	ExitDBAuth          = 4
+	ExitUpload          = 5
+	ExitRetention       = 6
+	ExitVerification    = 7
+	ExitStorageConfig   = 8
+)
+
+// ExitCode maps an error to the process exit code for that failure class
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrDumpToolMissing):
+		return ExitDumpToolMissing
+	case errors.Is(err, ErrDBAuth):
+		return ExitDBAuth
+	case errors.Is(err, ErrUpload):
+		return ExitUpload
+	case errors.Is(err, ErrRetention):
+		return ExitRetention
+	case errors.Is(err, ErrVerification):
+		return ExitVerification
+	case errors.Is(err, ErrStorageConfig):
+		return ExitStorageConfig
+	default:
+		return ExitFailure
+	}
 }
 
 // NewBackupManager creates a new backup manager
@@ -56,15 +383,33 @@ func NewBackupManager(configData *BackupConfig) (*BackupManager, error) {
 
 	// Initialize S3 client if S3 configuration is provided
 	if configData.S3Bucket != "" {
+		httpClient, err := s3HTTPClient(configData)
+		if err != nil {
+			return nil, err
+		}
+
 		// Load default config
-		cfg, err := config.LoadDefaultConfig(context.TODO(),
+		opts := []func(*config.LoadOptions) error{
 			config.WithRegion(configData.S3Region),
 			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				os.Getenv("AWS_ACCESS_KEY_ID"),
-				os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				configData.S3AccessKeyID,
+				configData.S3SecretAccessKey,
 				"",
 			)),
-		)
+			config.WithHTTPClient(httpClient),
+		}
+		if configData.S3RetryMode != "" {
+			mode, err := aws.ParseRetryMode(configData.S3RetryMode)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, config.WithRetryMode(mode))
+		}
+		if configData.S3MaxAttempts > 0 {
+			opts = append(opts, config.WithRetryMaxAttempts(configData.S3MaxAttempts))
+		}
+
+		cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load AWS config: %v", err)
 		}
@@ -79,273 +424,3318 @@ func NewBackupManager(configData *BackupConfig) (*BackupManager, error) {
 		bm.s3Svc = s3.NewFromConfig(cfg)
 	}
 
+	// Render the FTP directory once; it stays fixed for the life of the job
+	if configData.FTPHost != "" {
+		dir, err := renderFTPDir(configData)
+		if err != nil {
+			return nil, err
+		}
+		bm.ftpDir = dir
+		if configData.FTPTLS != "" {
+			if bm.ftpTLS, err = ftpTLSConfig(configData); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Parse the restore script template up front so mistakes fail fast
+	if configData.RestoreScript {
+		text := defaultRestoreScript
+		if configData.RestoreScriptTemplate != "" {
+			data, err := os.ReadFile(configData.RestoreScriptTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read restore script template: %v", err)
+			}
+			text = string(data)
+		}
+		tmpl, err := template.New("restore").Funcs(template.FuncMap{"sh": shellQuote}).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid restore script template: %v", err)
+		}
+		bm.restoreTemplate = tmpl
+	}
+
+	// Open the audit log before anything can be deleted
+	if configData.AuditLog != "" || configData.AuditS3 {
+		bm.actor = auditActor()
+	}
+	if configData.AuditLog != "" {
+		file, err := os.OpenFile(configData.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %v", err)
+		}
+		bm.auditFile = file
+	}
+
+	// Load encryption keys, including KMS clients for kms: entries
+	if len(configData.EncryptionKeys) > 0 || len(configData.RetiredKeys) > 0 {
+		keys, err := loadKeyring(configData.EncryptionKeys, configData.RetiredKeys, configData.KMSRegion)
+		if err != nil {
+			return nil, err
+		}
+		bm.keys = keys
+	}
+
 	// Connect to the database
 	// Map "mariadb" to "mysql" driver as sqlx/go-sql-driver uses "mysql" for both
 	driverName := configData.Connection
 	if driverName == "mariadb" {
 		driverName = "mysql"
+	} else if driverName == "postgresql" {
+		driverName = "postgres"
 	}
 
 	// Only connect to SQL database if not using Redis
-	if configData.Connection != "redis" {
+	if configData.Connection != "redis" && !configData.Offline {
 		dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", configData.DBUser, configData.DBPassword, configData.DBHost, configData.DBPort, configData.DBName)
+		if driverName == "postgres" {
+			// lib/pq takes a key/value DSN. Its sslmode default (require)
+			// differs from pg_dump's, so it is always set explicitly.
+			dsn = fmt.Sprintf("host=%s port=%s user=%s password='%s' dbname=%s sslmode=%s",
+				configData.DBHost, configData.DBPort, configData.DBUser,
+				strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(configData.DBPassword), configData.DBName,
+				cmp.Or(configData.DBSSLMode, "disable"))
+		}
 		db, err := sqlx.Connect(driverName, dsn)
 		if err != nil {
+			if isAuthError(err) {
+				return nil, fmt.Errorf("%w: %v", ErrDBAuth, err)
+			}
 			return nil, fmt.Errorf("failed to connect to database: %v", err)
 		}
 		bm.db = db
 	}
 
+	allStats.Lock()
+	allStats.list = append(allStats.list, &bm.stats)
+	allStats.Unlock()
+
 	return bm, nil
 }
 
+// s3HTTPClient builds the HTTP client used for S3 from the proxy, CA bundle
+// and timeout settings
+func s3HTTPClient(cfg *BackupConfig) (*awshttp.BuildableClient, error) {
+	var proxyURL *url.URL
+	if cfg.S3Proxy != "" {
+		var err error
+		if proxyURL, err = url.Parse(cfg.S3Proxy); err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid S3 proxy URL: %s", cfg.S3Proxy)
+		}
+	}
+
+	rootCAs, err := loadCABundle("S3", cfg.S3CABundle)
+	if err != nil {
+		return nil, err
+	}
+
+	client := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		if proxyURL != nil {
+			tr.Proxy = http.ProxyURL(proxyURL)
+		}
+		if rootCAs != nil {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.RootCAs = rootCAs
+		}
+	})
+	if cfg.S3Timeout > 0 {
+		client = client.WithTimeout(cfg.S3Timeout)
+	}
+	return client, nil
+}
+
+// loadCABundle returns the system roots plus the certificates in file, or
+// nil when file is empty
+func loadCABundle(name, file string) (*x509.CertPool, error) {
+	if file == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s CA bundle: %v", name, err)
+	}
+	// Trust the bundle in addition to the system roots
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s CA bundle %s", name, file)
+	}
+	return rootCAs, nil
+}
+
+// ftpTLSConfig builds the TLS configuration shared by the FTPS control and
+// data connections. The session cache lets data connections resume the
+// control session, which servers such as vsftpd require by default.
+func ftpTLSConfig(cfg *BackupConfig) (*tls.Config, error) {
+	rootCAs, err := loadCABundle("FTP", cfg.FTPCABundle)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		ServerName:         cfg.FTPHost,
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: cfg.FTPInsecure,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}, nil
+}
+
+// ftpDirData is passed to the FTP directory template
+type ftpDirData struct {
+	Host       string
+	Connection string
+	Database   string
+	Labels     map[string]string
+}
+
+// renderFTPDir renders the FTPDir template. An empty result means the
+// directory the FTP user logs into.
+func renderFTPDir(cfg *BackupConfig) (string, error) {
+	tmpl, err := template.New("ftp-dir").Option("missingkey=error").Parse(cfg.FTPDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid FTP directory template: %v", err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	var buf strings.Builder
+	err = tmpl.Execute(&buf, ftpDirData{
+		Host:       host,
+		Connection: cfg.Connection,
+		Database:   cfg.DBName,
+		Labels:     cfg.Labels,
+	})
+	if err != nil {
+		return "", fmt.Errorf("invalid FTP directory template: %v", err)
+	}
+	if buf.Len() == 0 {
+		return "", nil
+	}
+	return path.Clean(buf.String()), nil
+}
+
+// ftpLocation describes a remote path for logs and the audit trail
+func (bm *BackupManager) ftpLocation(remotePath string) string {
+	if strings.HasPrefix(remotePath, "/") {
+		return "ftp://" + bm.config.FTPHost + remotePath
+	}
+	return "ftp://" + bm.config.FTPHost + "/" + remotePath
+}
+
+// ftpPath returns the remote path of a file in the FTP directory
+func (bm *BackupManager) ftpPath(name string) string {
+	if bm.ftpDir == "" {
+		return name
+	}
+	return path.Join(bm.ftpDir, name)
+}
+
 // Run starts the continuous backup process
 func (bm *BackupManager) Run() error {
 	log.Printf("Starting high-frequency database backup for connection: %s", bm.config.Connection)
 	log.Printf("Backup path: %s", bm.config.Path)
 	log.Printf("Interval: %v", bm.config.Interval)
+	log.Printf("Jitter: ±%v", bm.config.Jitter)
 	log.Printf("Max files to keep: %d", bm.config.MaxFiles)
 	log.Printf("Compression: %t", bm.config.Gzip)
 	log.Printf("Using S3: %t", bm.config.S3Bucket != "")
+	log.Printf("Using FTP: %t", bm.config.FTPHost != "")
 
 	// Ensure backup directory exists
 	if err := os.MkdirAll(bm.config.Path, 0755); err != nil {
 		return fmt.Errorf("failed to create backup directory: %v", err)
 	}
 
+	// Spread hosts sharing the same interval across it before the first cycle
+	if bm.config.HostOffset {
+		offset := hostOffset(bm.config.Interval)
+		log.Printf("Waiting per-host offset of %v before first backup", offset)
+		time.Sleep(offset)
+	}
+
 	counter := 0
 	for {
-		startTime := time.Now()
+		if err := bm.RunOnce(counter); err != nil {
+			log.Printf("Backup cycle failed: %v", err)
+		} else {
+			counter++
+		}
 
-		// Generate filename with timestamp
-		timestamp := time.Now().Format("2006-01-02_15-04-05")
+		// Sleep for the specified interval, randomised by the configured jitter
+		time.Sleep(bm.nextInterval())
+	}
+}
 
-		var extension string
-		if bm.config.Connection == "redis" {
-			extension = "rdb"
-		} else {
-			extension = "sql"
+// RunOnce performs a single backup cycle: dump, verify, upload and retention.
+// The returned error wraps one of the Err* sentinels so callers can tell
+// which stage failed.
+func (bm *BackupManager) RunOnce(counter int) error {
+	startTime := time.Now()
+	err := bm.runCycle(counter)
+
+	now := time.Now()
+	bm.stats.cycles.Add(1)
+	bm.stats.lastCycle.Store(int64(now.Sub(startTime)))
+	bm.stats.lastCycleEnd.Store(now.UnixNano())
+	if err != nil {
+		bm.stats.cyclesFailed.Add(1)
+	} else {
+		bm.stats.lastSuccess.Store(now.Unix())
+	}
+	return err
+}
+
+func (bm *BackupManager) runCycle(counter int) error {
+	if err := os.MkdirAll(bm.config.Path, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	// Generate filename with timestamp
+	timestamp := time.Now().Format("2006-01-02_15-04-05")
+	stem := fmt.Sprintf("backup_%s_%06d", timestamp, counter)
+
+	artifacts, err := bm.artifacts(stem)
+	if err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+
+	// Dump, compress and encrypt the artifacts concurrently. Nothing is
+	// uploaded until every dump has succeeded: a failed dump discards the
+	// whole cycle, so no partial backup is left for retention to count.
+	files := make([]ManifestFile, len(artifacts))
+	errs := make([]error, len(artifacts))
+	bm.parallel(len(artifacts), func(i int) {
+		files[i], errs[i] = bm.backupArtifact(timestamp, artifacts[i])
+	})
+	if err := errors.Join(errs...); err != nil {
+		bm.discardCycle(stem)
+		return err
+	}
+
+	// Upload concurrently; failed uploads stay local
+	bm.parallel(len(files), func(i int) {
+		errs[i] = bm.uploadArtifact(timestamp, &files[i])
+	})
+	var uploadErr error
+	for _, err := range errs {
+		uploadErr = cmp.Or(uploadErr, err)
+	}
+
+	backup := ManifestBackup{
+		ID:         stem,
+		CreatedAt:  time.Now().UTC(),
+		Connection: bm.config.Connection,
+		Database:   bm.config.DBName,
+		Labels:     bm.config.Labels,
+		Files:      files,
+	}
+
+	// Ship a restore script alongside the backup it restores
+	if bm.restoreTemplate != nil {
+		script, err := bm.writeRestoreScript(timestamp, backup)
+		if errors.Is(err, ErrUpload) {
+			uploadErr = cmp.Or(uploadErr, err)
+		} else if err != nil {
+			return err
 		}
+		backup.Files = append(backup.Files, script)
+	}
 
-		filename := fmt.Sprintf("backup_%s_%06d.%s", timestamp, counter, extension)
-		localPath := filepath.Join(bm.config.Path, filename)
+	if err := bm.recordBackup(backup); err != nil {
+		log.Printf("Failed to update manifest: %v", err)
+		uploadErr = cmp.Or(uploadErr, err)
+	}
 
-		// Perform the backup
-		err := bm.performBackup(localPath)
-		if err != nil {
-			log.Printf("Backup failed: %v", err)
-			time.Sleep(bm.config.Interval)
-			continue
+	// Clean up old backups
+	var cleanupErr error
+	if bm.config.S3Bucket != "" {
+		cleanupErr = bm.cleanupOldBackupsS3()
+	} else if bm.config.FTPHost == "" {
+		cleanupErr = bm.cleanupOldBackups()
+	}
+	if bm.config.FTPHost != "" {
+		cleanupErr = cmp.Or(cleanupErr, bm.cleanupOldBackupsFTP())
+	}
+
+	if uploadErr != nil {
+		return uploadErr
+	}
+	return cleanupErr
+}
+
+// nextInterval returns the interval to sleep before the next cycle,
+// shifted by a random amount within ±Jitter
+func (bm *BackupManager) nextInterval() time.Duration {
+	if bm.config.Jitter <= 0 {
+		return bm.config.Interval
+	}
+	return bm.config.Interval + rand.N(2*bm.config.Jitter+1) - bm.config.Jitter
+}
+
+// parallel calls fn for 0 to n-1, running at most Parallelism at a time
+func (bm *BackupManager) parallel(n int, fn func(i int)) {
+	sem := make(chan struct{}, max(bm.config.Parallelism, 1))
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			bm.stats.inFlight.Add(1)
+			defer bm.stats.inFlight.Add(-1)
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// discardCycle removes every local file of a failed cycle
+func (bm *BackupManager) discardCycle(stem string) {
+	paths, _ := filepath.Glob(filepath.Join(bm.config.Path, stem+".*"))
+	for _, path := range paths {
+		err := os.Remove(path)
+		bm.audit(AuditEvent{Action: AuditDeleteLocal, Target: path, Trigger: "failed-cycle"}, err)
+		if err == nil {
+			log.Printf("Discarded %s from failed cycle", filepath.Base(path))
+		}
+	}
+}
+
+// backupArtifact dumps, verifies and, when keys are configured, encrypts a
+// single artifact, leaving it in the backup path for uploadArtifact
+func (bm *BackupManager) backupArtifact(timestamp string, a artifact) (ManifestFile, error) {
+	startTime := time.Now()
+	localPath := filepath.Join(bm.config.Path, a.name)
+
+	// If compression is enabled, the file will have .gz extension
+	checkPath := localPath
+	if bm.config.Gzip {
+		checkPath += ".gz"
+	}
+
+	// Perform the backup; a failed dump leaves nothing behind
+	if err := bm.performBackup(localPath, a.part, a.table); err != nil {
+		os.Remove(checkPath)
+		return ManifestFile{}, fmt.Errorf("backup failed: %w", err)
+	}
+
+	// Verify the dump before shipping it anywhere; a bad dump must not stay
+	// behind for retention to count
+	size, err := verifyBackup(checkPath)
+	if err != nil {
+		os.Remove(checkPath)
+		return ManifestFile{}, err
+	}
+	// Encrypt under a fresh data key, wrapped for each configured key
+	var encryption *FileEncryption
+	if bm.keys != nil && len(bm.keys.recipients) > 0 {
+		if encryption, err = bm.encryptArtifact(checkPath); err != nil {
+			return ManifestFile{}, err
+		}
+		checkPath += ".enc"
+		if size, err = getFileSize(checkPath); err != nil {
+			return ManifestFile{}, err
 		}
+	}
+
+	sum, err := fileSHA256(checkPath)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+
+	bm.stats.bytes.Add(size)
+
+	duration := time.Since(startTime)
+	log.Printf("[%s] Local backup %s completed in %v, size: %s", timestamp, filepath.Base(checkPath), duration, formatBytes(size))
 
-		// If compression is enabled, the file will have .gz extension
-		checkPath := localPath
-		if bm.config.Gzip {
-			checkPath += ".gz"
+	file := ManifestFile{
+		Name:   filepath.Base(checkPath),
+		Part:   a.part,
+		Table:  a.table,
+		Size:   size,
+		SHA256: sum,
+
+		Encryption: encryption,
+	}
+	return file, nil
+}
+
+// uploadArtifact stores a finished artifact remotely. Upload failures leave
+// the local file in place and are returned wrapping ErrUpload.
+func (bm *BackupManager) uploadArtifact(timestamp string, file *ManifestFile) error {
+	localPath := filepath.Join(bm.config.Path, file.Name)
+
+	// Ship the key record first so an uploaded file is never without its keys
+	if file.Encryption != nil {
+		if err := bm.storeRemote(timestamp, localPath+keyRecordSuffix, &ManifestFile{}); err != nil {
+			return err
 		}
+	}
+	return bm.storeRemote(timestamp, localPath, file)
+}
 
-		// Calculate backup size
-		size, err := getFileSize(checkPath)
-		if err != nil {
-			log.Printf("Error getting backup size: %v", err)
-		} else {
-			duration := time.Since(startTime)
-			log.Printf("[%s] Local backup completed in %v, size: %s", timestamp, duration, formatBytes(size))
+// storeRemote uploads a finished file to S3 and/or FTP when configured,
+// records where it went in file, and removes the local copy once every
+// upload has succeeded.
+func (bm *BackupManager) storeRemote(timestamp, localPath string, file *ManifestFile) error {
+	if bm.config.S3Bucket == "" && bm.config.FTPHost == "" {
+		return nil
+	}
 
-			// Upload to S3 if configured
-			if bm.config.S3Bucket != "" {
-				s3StartTime := time.Now()
+	var destinations []string
+	if bm.config.S3Bucket != "" {
+		s3StartTime := time.Now()
 
-				s3Key := fmt.Sprintf("%s%s", bm.config.S3Prefix, filepath.Base(checkPath))
-				err = bm.uploadToS3(checkPath, s3Key)
-				if err != nil {
-					log.Printf("Failed to upload to S3: %v", err)
-				} else {
-					s3Duration := time.Since(s3StartTime)
-					log.Printf("[%s] Uploaded to S3 in %v, S3 Key: %s", timestamp, s3Duration, s3Key)
+		s3Key := fmt.Sprintf("%s%s", bm.config.S3Prefix, filepath.Base(localPath))
+		if err := bm.uploadToS3(localPath, s3Key); err != nil {
+			log.Printf("Failed to upload to S3: %v", err)
+			return err
+		}
+		s3Duration := time.Since(s3StartTime)
+		log.Printf("[%s] Uploaded to S3 in %v, S3 Key: %s", timestamp, s3Duration, s3Key)
+		file.S3Key = s3Key
+		destinations = append(destinations, "s3://"+bm.config.S3Bucket+"/"+s3Key)
+	}
+
+	if bm.config.FTPHost != "" {
+		ftpStartTime := time.Now()
+
+		remotePath := bm.ftpPath(filepath.Base(localPath))
+		if err := bm.uploadToFTP(localPath, remotePath); err != nil {
+			log.Printf("Failed to upload to FTP: %v", err)
+			return err
+		}
+		log.Printf("[%s] Uploaded to FTP in %v, path: %s", timestamp, time.Since(ftpStartTime), remotePath)
+		file.FTPPath = remotePath
+		destinations = append(destinations, bm.ftpLocation(remotePath))
+	}
+
+	// Optionally delete local file after successful upload to save space
+	err := os.Remove(localPath)
+	bm.audit(AuditEvent{Action: AuditRemoveUploaded, Target: localPath, Trigger: "upload", Detail: "uploaded to " + strings.Join(destinations, ", ")}, err)
+
+	return nil
+}
+
+// restoreScriptData is passed to the restore script template
+type restoreScriptData struct {
+	Backup      ManifestBackup
+	Engine      string // "mysql", "postgres" or "redis"
+	RedisFormat string
+	DBHost      string
+	DBPort      string
+	DBUser      string
+	BackupPath  string
+	S3Bucket    string
+	S3Region    string
+	S3Endpoint  string
+	S3Prefix    string
+	FTPURL      string // ftp:// or ftps:// URL of the server, for curl
+	FTPUser     string
+	FTPTLS      bool
+	Encrypted   bool
+}
+
+// writeRestoreScript renders the restore script for a completed backup and
+// stores it like the backup files
+func (bm *BackupManager) writeRestoreScript(timestamp string, backup ManifestBackup) (ManifestFile, error) {
+	data := restoreScriptData{
+		Backup:      backup,
+		Engine:      bm.config.Connection,
+		RedisFormat: bm.config.RedisFormat,
+		DBHost:      bm.config.DBHost,
+		DBPort:      bm.config.DBPort,
+		DBUser:      bm.config.DBUser,
+		BackupPath:  bm.config.Path,
+		S3Bucket:    bm.config.S3Bucket,
+		S3Region:    bm.config.S3Region,
+		S3Endpoint:  bm.config.S3Endpoint,
+		S3Prefix:    bm.config.S3Prefix,
+	}
+	if bm.config.FTPHost != "" {
+		scheme := "ftp"
+		if bm.config.FTPTLS == "implicit" {
+			scheme = "ftps"
+		}
+		host := bm.config.FTPHost
+		if bm.config.FTPPort != "" {
+			host = net.JoinHostPort(host, bm.config.FTPPort)
+		}
+		data.FTPURL = scheme + "://" + host
+		data.FTPUser = bm.config.FTPUser
+		data.FTPTLS = bm.config.FTPTLS != ""
+	}
+	switch data.Engine {
+	case "mariadb":
+		data.Engine = "mysql"
+	case "postgresql":
+		data.Engine = "postgres"
+	}
+	for _, f := range backup.Files {
+		if f.Encryption != nil {
+			data.Encrypted = true
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := bm.restoreTemplate.Execute(&buf, data); err != nil {
+		return ManifestFile{}, fmt.Errorf("failed to render restore script: %v", err)
+	}
+
+	localPath := filepath.Join(bm.config.Path, backup.ID+".restore.sh")
+	if err := os.WriteFile(localPath, buf.Bytes(), 0755); err != nil {
+		return ManifestFile{}, fmt.Errorf("failed to write restore script: %v", err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+
+	file := ManifestFile{
+		Name:   filepath.Base(localPath),
+		Part:   "restore-script",
+		Size:   int64(buf.Len()),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+	err := bm.storeRemote(timestamp, localPath, &file)
+	return file, err
+}
+
+// artifacts lists the files to produce for the backup identified by stem.
+// With PerTable the data is split into one file per table, while the schema
+// dump stays whole so routines and views are kept.
+func (bm *BackupManager) artifacts(stem string) ([]artifact, error) {
+	var tables []string
+	if bm.config.PerTable {
+		var err error
+		if tables, err = bm.listTables(); err != nil {
+			return nil, err
+		}
+	}
+
+	var list []artifact
+	for _, part := range bm.parts() {
+		name := stem
+		if part != "" {
+			name += "." + part
+		}
+		if !bm.config.PerTable || part != "data" {
+			list = append(list, artifact{name: name + "." + bm.extension(), part: part})
+			continue
+		}
+		for _, table := range tables {
+			list = append(list, artifact{
+				name:  name + ".table." + safeFileName(table) + "." + bm.extension(),
+				part:  part,
+				table: table,
+			})
+		}
+	}
+	return list, nil
+}
+
+// listTables returns the tables in the configured database. PostgreSQL
+// tables are schema-qualified.
+func (bm *BackupManager) listTables() ([]string, error) {
+	if bm.db == nil {
+		return nil, fmt.Errorf("per-table dumps require a SQL connection")
+	}
+
+	var tables []string
+	var err error
+	switch bm.db.DriverName() {
+	case "postgres":
+		err = bm.db.Select(&tables, `SELECT schemaname || '.' || tablename FROM pg_tables
+			WHERE schemaname NOT IN ('pg_catalog', 'information_schema') ORDER BY 1`)
+	default:
+		err = bm.db.Select(&tables, `SELECT table_name FROM information_schema.tables
+			WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE' ORDER BY 1`)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %v", err)
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables found in database %s", bm.config.DBName)
+	}
+	return tables, nil
+}
+
+// parts returns the artifacts produced each cycle, in restore order: "" for
+// a full dump, "schema" and/or "data" when the schema and data are dumped
+// separately. Per-table dumps always split, since views and routines belong
+// to no table. PostgreSQL per-table data loads table by table in name order,
+// so its schema is split around the data: constraints, indexes and triggers
+// (post-data) are only created once every table is loaded.
+func (bm *BackupManager) parts() []string {
+	perTable := bm.config.PerTable && !bm.config.SchemaOnly && !bm.config.DataOnly
+	switch {
+	case perTable && (bm.config.Connection == "postgres" || bm.config.Connection == "postgresql"):
+		return []string{"schema.pre-data", "data", "schema.post-data"}
+	case bm.config.SplitSchema, perTable:
+		return []string{"schema", "data"}
+	case bm.config.SchemaOnly:
+		return []string{"schema"}
+	case bm.config.DataOnly:
+		return []string{"data"}
+	default:
+		return []string{""}
+	}
+}
+
+// extension returns the file extension for an uncompressed backup of the
+// configured connection and format
+func (bm *BackupManager) extension() string {
+	if bm.config.Connection != "redis" {
+		return "sql"
+	}
+	switch bm.config.RedisFormat {
+	case "aof":
+		return "aof.tar"
+	case "logical":
+		return "resp"
+	default:
+		return "rdb"
+	}
+}
+
+// dumpTool returns the client binary used to dump the configured connection,
+// preferring mariadb-dump over mysqldump for MySQL and MariaDB
+func (bm *BackupManager) dumpTool() (string, error) {
+	var candidates []string
+	switch bm.config.Connection {
+	case "mysql", "mariadb":
+		candidates = []string{"mariadb-dump", "mysqldump"}
+	case "postgres", "postgresql":
+		candidates = []string{"pg_dump"}
+	case "redis":
+		switch bm.config.RedisFormat {
+		case "aof":
+			candidates = []string{"tar"}
+		case "logical":
+			// Logical exports talk RESP directly and need no client tools
+			return "", nil
+		default:
+			candidates = []string{"redis-cli"}
+		}
+	default:
+		return "", fmt.Errorf("unsupported database connection: %s", bm.config.Connection)
+	}
+
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s not found in PATH; install the database client tools", ErrDumpToolMissing, strings.Join(candidates, " or "))
+}
+
+// Preflight validates the environment before the first cycle: the dump tool
+// (and nice and ionice for Optimize) is installed, the database accepts the
+// credentials, the backup path is writable and, when configured, the S3
+// bucket and FTP server accept writes and deletes.
+func (bm *BackupManager) Preflight() error {
+	tool, err := bm.dumpTool()
+	if err != nil {
+		return err
+	}
+	// Compression runs in process; only the priority wrappers are external.
+	// They are missing from some minimal images, such as BusyBox.
+	if bm.config.Optimize && tool != "" {
+		for _, wrapper := range []string{"nice", "ionice"} {
+			if _, err := exec.LookPath(wrapper); err != nil {
+				return fmt.Errorf("%w: %s not found in PATH; install it or turn off -optimize", ErrDumpToolMissing, wrapper)
+			}
+		}
+	}
+
+	if bm.db != nil {
+		if err := bm.db.Ping(); err != nil {
+			if isAuthError(err) {
+				return fmt.Errorf("%w: check -db-user and -db-password: %v", ErrDBAuth, err)
+			}
+			return fmt.Errorf("database %s:%s is not reachable: %v", bm.config.DBHost, bm.config.DBPort, err)
+		}
+	} else if bm.config.Connection == "redis" {
+		if err := bm.pingRedis(); err != nil {
+			return err
+		}
+		if bm.config.RedisFormat == "aof" {
+			if _, err := os.Stat(bm.config.RedisAOFPath); err != nil {
+				return fmt.Errorf("redis AOF path is not readable; set -redis-aof-path to appendonly.aof or appendonlydir: %v", err)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(bm.config.Path, 0755); err != nil {
+		return fmt.Errorf("backup path %s cannot be created: %v", bm.config.Path, err)
+	}
+	probe, err := os.CreateTemp(bm.config.Path, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("backup path %s is not writable by this user: %v", bm.config.Path, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	if bm.s3Svc != nil {
+		key := fmt.Sprintf("%s.preflight-%d", bm.config.S3Prefix, time.Now().UnixNano())
+		_, err := bm.s3Svc.PutObject(context.TODO(), bm.backupObjectInput(key, strings.NewReader("preflight")))
+		if err != nil {
+			return fmt.Errorf("%w: S3 bucket %s is not writable; check credentials, region, endpoint and, with -labels, s3:PutObjectTagging: %v", ErrStorageConfig, bm.config.S3Bucket, err)
+		}
+		_, err = bm.s3Svc.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+			Bucket: aws.String(bm.config.S3Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("%w: cannot delete objects in S3 bucket %s, so old backups could not be pruned: %v", ErrStorageConfig, bm.config.S3Bucket, err)
+		}
+	}
+
+	if bm.config.FTPHost != "" {
+		remotePath := bm.ftpPath(fmt.Sprintf(".preflight-%d", time.Now().UnixNano()))
+		if err := bm.storeFTP(remotePath, strings.NewReader("preflight")); err != nil {
+			return fmt.Errorf("%w: FTP server %s is not writable; check -ftp-user, -ftp-password, -ftp-dir and the TLS and passive/active settings: %v", ErrStorageConfig, bm.config.FTPHost, err)
+		}
+		c, err := dialFTP(bm.config, bm.ftpTLS)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUpload, err)
+		}
+		defer c.Close()
+		if _, err := c.list(bm.ftpDir); err != nil {
+			return fmt.Errorf("%w: cannot list FTP directory %s, so old backups could not be pruned: %v", ErrStorageConfig, bm.ftpDir, err)
+		}
+		if err := c.delete(remotePath); err != nil {
+			return fmt.Errorf("%w: cannot delete files on FTP server %s, so old backups could not be pruned: %v", ErrStorageConfig, bm.config.FTPHost, err)
+		}
+	}
+
+	return nil
+}
+
+// pingRedis checks that Redis is reachable and accepts the configured password
+func (bm *BackupManager) pingRedis() error {
+	c, err := dialRedis(bm.config)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, err := c.do("PING"); err != nil {
+		return fmt.Errorf("redis %s:%s did not answer PING: %v", bm.config.DBHost, bm.config.DBPort, err)
+	}
+	return nil
+}
+
+// performBackup executes the actual database backup. part selects a
+// schema-only ("schema") or data-only ("data") dump for SQL connections, or
+// one PostgreSQL schema section ("schema.pre-data", "schema.post-data"); an
+// empty part dumps both. A non-empty table limits the dump to that table.
+func (bm *BackupManager) performBackup(outputPath, part, table string) error {
+	var args []string
+	var env []string
+
+	switch bm.config.Connection {
+	case "mysql", "mariadb":
+		tool, err := bm.dumpTool()
+		if err != nil {
+			return err
+		}
+		args = []string{tool, "--host=" + bm.config.DBHost, "--port=" + bm.config.DBPort, "--user=" + bm.config.DBUser}
+		// Routines and triggers belong with the schema
+		switch part {
+		case "schema":
+			args = append(args, "--single-transaction", "--routines", "--triggers", "--no-data")
+		case "data":
+			args = append(args, "--single-transaction", "--no-create-info", "--skip-triggers")
+		default:
+			args = append(args, "--single-transaction", "--routines", "--triggers")
+		}
+		args = append(args, bm.config.DBName)
+		if table != "" {
+			args = append(args, table)
+		}
+		// Keep the password off the command line, where ps would show it
+		env = append(env, "MYSQL_PWD="+bm.config.DBPassword)
+	case "postgres", "postgresql":
+		if _, err := bm.dumpTool(); err != nil {
+			return err
+		}
+		args = []string{"pg_dump", "--host=" + bm.config.DBHost, "--port=" + bm.config.DBPort,
+			"--username=" + bm.config.DBUser, "--dbname=" + bm.config.DBName}
+		switch part {
+		case "schema":
+			args = append(args, "--schema-only")
+		case "schema.pre-data":
+			args = append(args, "--section=pre-data")
+		case "schema.post-data":
+			args = append(args, "--section=post-data")
+		case "data":
+			args = append(args, "--data-only")
+		}
+		if table != "" {
+			// Quote both identifiers so mixed-case names match exactly
+			schema, name, _ := strings.Cut(table, ".")
+			quote := strings.NewReplacer(`"`, `""`)
+			args = append(args, "--table="+`"`+quote.Replace(schema)+`"."`+quote.Replace(name)+`"`)
+		}
+		// Pass the password to pg_dump only, never through the process environment
+		env = append(env, "PGPASSWORD="+bm.config.DBPassword, "PGSSLMODE="+cmp.Or(bm.config.DBSSLMode, "disable"))
+	case "redis":
+		if _, err := bm.dumpTool(); err != nil {
+			return err
+		}
+
+		switch bm.config.RedisFormat {
+		case "logical":
+			return bm.dumpRedisLogical(outputPath)
+		case "aof":
+			// appendonly.aof (Redis < 7) or appendonlydir (Redis 7+) is copied
+			// as a tar archive so both layouts restore the same way
+			aof := filepath.Clean(bm.config.RedisAOFPath)
+			args = []string{"tar", "-C", filepath.Dir(aof), "-cf", "-", filepath.Base(aof)}
+		default:
+			// For Redis, we use redis-cli to trigger a save and then copy the dump file
+			// Note: This is a simplified approach. For production Redis, you might want to use BGSAVE
+			// and then copy the dump.rdb file, or use --rdb flag if available in newer redis-cli versions.
+			// Here we use the --rdb flag which dumps the RDB file to stdout
+
+			// If password is provided, pass REDISCLI_AUTH to redis-cli
+			// This avoids the warning about using password on command line
+			if bm.config.DBPassword != "" {
+				env = append(env, "REDISCLI_AUTH="+bm.config.DBPassword)
+			}
+
+			// redis-cli --rdb - (dash) writes to stdout
+			args = []string{"redis-cli", "-h", bm.config.DBHost, "-p", bm.config.DBPort, "--rdb", "-"}
+		}
+
+	default:
+		return fmt.Errorf("unsupported database connection: %s", bm.config.Connection)
+	}
+
+	// Add optimization if needed
+	if bm.config.Optimize {
+		args = append([]string{"nice", "-n19", "ionice", "-c3"}, args...)
+	}
+
+	// If compression is enabled, the file gets a .gz extension; the caller
+	// knows to look for it
+	if bm.config.Gzip {
+		outputPath += ".gz"
+	}
+	return runDump(outputPath, bm.config.Gzip, args, env)
+}
+
+// uploadToS3 uploads the backup file to S3
+func (bm *BackupManager) uploadToS3(filePath, s3Key string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("%w: failed to open file: %v", ErrUpload, err)
+	}
+	defer file.Close()
+
+	_, err = bm.s3Svc.PutObject(context.TODO(), bm.backupObjectInput(s3Key, file))
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUpload, err)
+	}
+
+	return nil
+}
+
+// backupObjectInput builds the PutObject request for a backup file. Labels go
+// on as both metadata (returned with the object) and tags (usable in
+// lifecycle rules and cost allocation); tags need s3:PutObjectTagging, so the
+// preflight probe is sent the same way.
+func (bm *BackupManager) backupObjectInput(s3Key string, body io.Reader) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bm.config.S3Bucket),
+		Key:    aws.String(s3Key),
+		Body:   body,
+	}
+	if len(bm.config.Labels) > 0 {
+		tags := url.Values{}
+		for k, v := range bm.config.Labels {
+			tags.Set(k, v)
+		}
+		input.Metadata = bm.config.Labels
+		input.Tagging = aws.String(tags.Encode())
+	}
+	return input
+}
+
+// uploadToFTP uploads the backup file to the FTP server, creating the
+// directory first. Each upload uses its own connection so parallel uploads
+// do not share a control channel.
+func (bm *BackupManager) uploadToFTP(filePath, remotePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	return bm.storeFTP(remotePath, file)
+}
+
+// storeFTP writes r to remotePath on the FTP server
+func (bm *BackupManager) storeFTP(remotePath string, r io.Reader) error {
+	c, err := dialFTP(bm.config, bm.ftpTLS)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUpload, err)
+	}
+	defer c.Close()
+
+	if bm.ftpDir != "" {
+		c.mkdirAll(bm.ftpDir)
+	}
+	if err := c.store(remotePath, r); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrUpload, remotePath, err)
+	}
+	return nil
+}
+
+// cleanupOldBackups removes old backup files locally
+func (bm *BackupManager) cleanupOldBackups() error {
+	files, err := filepath.Glob(filepath.Join(bm.config.Path, "backup_*"))
+	if err != nil {
+		return fmt.Errorf("%w: error finding backup files: %v", ErrRetention, err)
+	}
+
+	// Filter files to only include backup files
+	var backupFiles []string
+	for _, file := range files {
+		base := filepath.Base(file)
+		if isBackupFile(base) {
+			backupFiles = append(backupFiles, file)
+		}
+	}
+
+	failed := 0
+	for _, file := range bm.expiredBackups(backupFiles) {
+		err := os.Remove(file)
+		bm.audit(AuditEvent{Action: AuditDeleteLocal, Target: file, Trigger: "retention"}, err)
+		if err != nil {
+			log.Printf("Failed to delete old backup: %v", err)
+			failed++
+		} else {
+			log.Printf("Deleted old backup: %s", filepath.Base(file))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w: failed to delete %d old backup(s)", ErrRetention, failed)
+	}
+	return nil
+}
+
+// listS3Objects returns the keys of every object under the S3 prefix
+func (bm *BackupManager) listS3Objects() ([]string, error) {
+	paginator := s3.NewListObjectsV2Paginator(bm.s3Svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bm.config.S3Bucket),
+		Prefix: aws.String(bm.config.S3Prefix),
+	})
+
+	var keys []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects: %v", err)
+		}
+		for _, obj := range page.Contents {
+			if obj.Key != nil {
+				keys = append(keys, *obj.Key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// cleanupOldBackupsS3 removes old backup files from S3
+func (bm *BackupManager) cleanupOldBackupsS3() error {
+	keys, err := bm.listS3Objects()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRetention, err)
+	}
+
+	// Filter for backup files
+	var backupKeys []string
+	for _, key := range keys {
+		if isBackupFile(key) {
+			backupKeys = append(backupKeys, key)
+		}
+	}
+
+	// Delete the oldest files beyond the retention limits
+	failed := 0
+	for _, key := range bm.expiredBackups(backupKeys) {
+		_, err := bm.s3Svc.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+			Bucket: aws.String(bm.config.S3Bucket),
+			Key:    aws.String(key),
+		})
+		bm.audit(AuditEvent{Action: AuditDeleteS3, Target: "s3://" + bm.config.S3Bucket + "/" + key, Trigger: "retention"}, err)
+
+		if err != nil {
+			log.Printf("Failed to delete old backup from S3: %v", err)
+			failed++
+		} else {
+			log.Printf("Deleted old backup from S3: %s", key)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w: failed to delete %d old backup(s) from S3", ErrRetention, failed)
+	}
+	return nil
+}
+
+// cleanupOldBackupsFTP removes old backup files from the FTP directory
+func (bm *BackupManager) cleanupOldBackupsFTP() error {
+	c, err := dialFTP(bm.config, bm.ftpTLS)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrRetention, err)
+	}
+	defer c.Close()
+
+	names, err := c.list(bm.ftpDir)
+	if err != nil {
+		return fmt.Errorf("%w: failed to list FTP directory: %v", ErrRetention, err)
+	}
+
+	// Filter for backup files; servers differ in whether NLST returns paths
+	var backupPaths []string
+	for _, name := range names {
+		if isBackupFile(path.Base(name)) {
+			backupPaths = append(backupPaths, bm.ftpPath(path.Base(name)))
+		}
+	}
+
+	// Delete the oldest files beyond the retention limits
+	failed := 0
+	for _, remotePath := range bm.expiredBackups(backupPaths) {
+		err := c.delete(remotePath)
+		bm.audit(AuditEvent{Action: AuditDeleteFTP, Target: bm.ftpLocation(remotePath), Trigger: "retention"}, err)
+
+		if err != nil {
+			log.Printf("Failed to delete old backup from FTP: %v", err)
+			failed++
+		} else {
+			log.Printf("Deleted old backup from FTP: %s", remotePath)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w: failed to delete %d old backup(s) from FTP", ErrRetention, failed)
+	}
+	return nil
+}
+
+// isBackupFile reports whether name looks like a backup written by this tool
+func isBackupFile(name string) bool {
+	if !strings.Contains(name, "backup_") {
+		return false
+	}
+	name = strings.TrimSuffix(name, keyRecordSuffix)
+	name = strings.TrimSuffix(name, ".enc")
+	name = strings.TrimSuffix(name, ".gz")
+	for _, ext := range []string{".sql", ".rdb", ".aof.tar", ".resp", ".restore.sh"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyBackup checks that a finished dump is non-empty and, when gzipped,
+// that the archive is intact. Dump tool failures are caught by runDump; this
+// guards against tools that exit cleanly without writing anything.
+func verifyBackup(path string) (int64, error) {
+	size, err := getFileSize(path)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrVerification, err)
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("%w: %s is empty", ErrVerification, filepath.Base(path))
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrVerification, err)
+		}
+		defer file.Close()
+
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s: %v", ErrVerification, filepath.Base(path), err)
+		}
+		n, err := io.Copy(io.Discard, zr)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s: %v", ErrVerification, filepath.Base(path), err)
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("%w: %s is empty", ErrVerification, filepath.Base(path))
+		}
+	}
+
+	return size, nil
+}
+
+// isAuthError reports whether a driver error means the server rejected the
+// credentials
+func isAuthError(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		// ER_DBACCESS_DENIED_ERROR, ER_ACCESS_DENIED_ERROR
+		return myErr.Number == 1044 || myErr.Number == 1045
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// invalid_authorization_specification, invalid_password
+		return pqErr.Code == "28000" || pqErr.Code == "28P01"
+	}
+	return false
+}
+
+// dumpRedisLogical exports every key matching RedisKeyPattern with SCAN and
+// DUMP, writing one RESTORE command per key in RESP. The file can be replayed
+// with `redis-cli --pipe` or restored selectively with the redis-restore command.
+func (bm *BackupManager) dumpRedisLogical(outputPath string) error {
+	c, err := dialRedis(bm.config)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if bm.config.Gzip {
+		outputPath += ".gz"
+	}
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %v", err)
+	}
+	defer file.Close()
+
+	var zw *gzip.Writer
+	var w *bufio.Writer
+	if bm.config.Gzip {
+		zw = gzip.NewWriter(file)
+		w = bufio.NewWriter(zw)
+	} else {
+		w = bufio.NewWriter(file)
+	}
+
+	pattern := bm.config.RedisKeyPattern
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return fmt.Errorf("redis SCAN failed: %v", err)
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return fmt.Errorf("unexpected SCAN reply: %v", reply)
+		}
+		cursor, _ = page[0].(string)
+		keys, _ := page[1].([]any)
+
+		// Pipeline DUMP and PTTL for the whole page
+		for _, key := range keys {
+			c.send("DUMP", key.(string))
+			c.send("PTTL", key.(string))
+		}
+		if err := c.w.Flush(); err != nil {
+			return fmt.Errorf("redis write failed: %v", err)
+		}
+
+		now := time.Now().UnixMilli()
+		for _, key := range keys {
+			payload, dumpErr := c.receive()
+			ttl, ttlErr := c.receive()
+			if dumpErr != nil || ttlErr != nil {
+				return fmt.Errorf("redis DUMP %s failed: %v", key, errors.Join(dumpErr, ttlErr))
+			}
+			// The key expired or was deleted between SCAN and DUMP
+			if payload == nil {
+				continue
+			}
+
+			args := []string{"RESTORE", key.(string), "0", payload.(string), "REPLACE"}
+			if ms, _ := ttl.(int64); ms > 0 {
+				args[2] = strconv.FormatInt(now+ms, 10)
+				args = append(args, "ABSTTL")
+			}
+			writeRESP(w, args...)
+		}
+
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write backup file: %v", err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to write backup file: %v", err)
+		}
+	}
+	return file.Close()
+}
+
+// RestoreRedis replays a logical Redis backup against the configured server,
+// restoring only the keys that match pattern. It returns the number of keys
+// restored.
+func (bm *BackupManager) RestoreRedis(backupFile, pattern string) (int, error) {
+	restored, err := bm.restoreRedis(backupFile, pattern)
+	bm.audit(AuditEvent{
+		Action:  AuditRestore,
+		Target:  fmt.Sprintf("redis://%s", net.JoinHostPort(bm.config.DBHost, bm.config.DBPort)),
+		Trigger: "redis-restore",
+		Detail:  fmt.Sprintf("%d key(s) matching %q from %s", restored, pattern, backupFile),
+	}, err)
+	return restored, err
+}
+
+func (bm *BackupManager) restoreRedis(backupFile, pattern string) (int, error) {
+	file, err := os.Open(backupFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open backup: %v", err)
+	}
+	defer file.Close()
+
+	var src io.Reader = file
+	if strings.HasSuffix(backupFile, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read backup: %v", err)
+		}
+		defer zr.Close()
+		src = zr
+	}
+	r := bufio.NewReader(src)
+
+	c, err := dialRedis(bm.config)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	restored, failed, pending := 0, 0, 0
+	drain := func() {
+		for ; pending > 0; pending-- {
+			if _, err := c.receive(); err != nil {
+				log.Printf("RESTORE failed: %v", err)
+				failed++
+			} else {
+				restored++
+			}
+		}
+	}
+
+	for {
+		reply, err := readRESP(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, fmt.Errorf("corrupt backup %s: %v", filepath.Base(backupFile), err)
+		}
+		args, ok := reply.([]any)
+		if !ok || len(args) < 4 || args[0] != "RESTORE" {
+			return restored, fmt.Errorf("corrupt backup %s: unexpected entry", filepath.Base(backupFile))
+		}
+		key, _ := args[1].(string)
+		if !redisGlobMatch(pattern, key) {
+			continue
+		}
+
+		strArgs := make([]string, len(args))
+		for i, arg := range args {
+			strArgs[i], _ = arg.(string)
+		}
+		c.send(strArgs...)
+		pending++
+
+		if pending == 1000 {
+			if err := c.w.Flush(); err != nil {
+				return restored, fmt.Errorf("redis write failed: %v", err)
+			}
+			drain()
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return restored, fmt.Errorf("redis write failed: %v", err)
+	}
+	drain()
+
+	if failed > 0 {
+		return restored, fmt.Errorf("%d key(s) failed to restore", failed)
+	}
+	return restored, nil
+}
+
+// redisGlobMatch reports whether key matches pattern the way Redis KEYS and
+// SCAN MATCH do: * and ? also match '/', [^...] negates a class, a-z ranges
+// may be reversed and \ escapes the next character. Like Redis, it never
+// rejects a pattern.
+func redisGlobMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if redisGlobMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					match = match || pattern[0] == key[0]
+				case len(pattern) >= 3 && pattern[1] == '-':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (key[0] >= lo && key[0] <= hi)
+					pattern = pattern[2:]
+				default:
+					match = match || pattern[0] == key[0]
+				}
+				pattern = pattern[1:]
+			}
+			if match == negate {
+				return false
+			}
+			// An unterminated class runs to the end of the pattern
+			if len(pattern) == 0 {
+				return len(key) == 1
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// redisConn is a minimal RESP client covering what the backup needs
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// dialRedis connects to the configured Redis server and authenticates
+func dialRedis(cfg *BackupConfig) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(cfg.DBHost, cfg.DBPort), 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("redis %s:%s is not reachable: %v", cfg.DBHost, cfg.DBPort, err)
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if cfg.DBPassword != "" {
+		args := []string{"AUTH", cfg.DBPassword}
+		if cfg.DBUser != "" {
+			args = []string{"AUTH", cfg.DBUser, cfg.DBPassword}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%w: check -db-password: %v", ErrDBAuth, err)
+		}
+	}
+	return c, nil
+}
+
+// do sends a single command and waits for its reply
+func (c *redisConn) do(args ...string) (any, error) {
+	c.send(args...)
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := c.receive()
+	var replyErr redisError
+	if errors.As(err, &replyErr) && (strings.HasPrefix(string(replyErr), "NOAUTH") || strings.HasPrefix(string(replyErr), "WRONGPASS")) {
+		return nil, fmt.Errorf("%w: %v", ErrDBAuth, err)
+	}
+	return reply, err
+}
+
+// send buffers a command without waiting for the reply, for pipelining
+func (c *redisConn) send(args ...string) {
+	writeRESP(c.w, args...)
+}
+
+// receive reads the next reply from the server
+func (c *redisConn) receive() (any, error) {
+	return readRESP(c.r)
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// writeRESP encodes a command as a RESP array of bulk strings
+func writeRESP(w *bufio.Writer, args ...string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// readRESP decodes one RESP value. Bulk and simple strings become string,
+// integers int64, arrays []any and nulls nil; error replies are returned as
+// redisError.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("malformed RESP line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed RESP bulk length: %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed RESP array length: %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown RESP type %q", line[0])
+	}
+}
+
+// ftpConn is a minimal FTP client covering what backups need: uploads,
+// listings and deletes over plain FTP or FTPS, in passive or active mode
+type ftpConn struct {
+	conn    net.Conn
+	text    *textproto.Conn
+	cfg     *BackupConfig
+	tls     *tls.Config
+	private bool // data connections are TLS-protected (PROT P)
+	timeout time.Duration
+}
+
+// dialFTP connects to the configured FTP server, negotiates TLS and logs in
+func dialFTP(cfg *BackupConfig, tlsConfig *tls.Config) (*ftpConn, error) {
+	port := cfg.FTPPort
+	if port == "" {
+		port = "21"
+		if cfg.FTPTLS == "implicit" {
+			port = "990"
+		}
+	}
+	timeout := cmp.Or(cfg.FTPTimeout, time.Minute)
+
+	addr := net.JoinHostPort(cfg.FTPHost, port)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to FTP server %s: %v", addr, err)
+	}
+	if cfg.FTPTLS == "implicit" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn), cfg: cfg, tls: tlsConfig, timeout: timeout}
+
+	if err := c.login(); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("FTP server %s: %v", addr, err)
+	}
+	return c, nil
+}
+
+func (c *ftpConn) login() error {
+	if _, err := c.response(2); err != nil {
+		return err
+	}
+
+	if c.cfg.FTPTLS == "explicit" {
+		if _, err := c.cmd(2, "AUTH TLS"); err != nil {
+			return err
+		}
+		tlsConn := tls.Client(c.conn, c.tls)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		c.conn = tlsConn
+		c.text = textproto.NewConn(tlsConn)
+	}
+
+	user := cmp.Or(c.cfg.FTPUser, "anonymous")
+	code, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		code, err = c.cmd(0, "PASS %s", c.cfg.FTPPassword)
+		if err != nil {
+			return err
+		}
+	}
+	if code != 230 && code != 202 {
+		return fmt.Errorf("login as %s rejected (%d)", user, code)
+	}
+
+	if c.cfg.FTPTLS != "" {
+		if _, err := c.cmd(2, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, err := c.cmd(2, "PROT P"); err != nil {
+			return err
+		}
+		c.private = true
+	}
+	_, err = c.cmd(2, "TYPE I")
+	return err
+}
+
+// cmd sends a command and reads the reply, which must match expect as in
+// textproto.Reader.ReadResponse (0 accepts any code)
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, err
+	}
+	return c.response(expect)
+}
+
+func (c *ftpConn) response(expect int) (int, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	code, msg, err := c.text.ReadResponse(expect)
+	if err != nil {
+		return code, err
+	}
+	if expect == 0 && code >= 400 {
+		return code, &textproto.Error{Code: code, Msg: msg}
+	}
+	return code, nil
+}
+
+// transfer runs a command that uses a data connection, such as STOR or
+// NLST, handing the connection to fn
+func (c *ftpConn) transfer(fn func(net.Conn) error, format string, args ...any) error {
+	var data net.Conn
+	var listener net.Listener
+	var err error
+	if c.cfg.FTPActive {
+		if listener, err = c.port(); err != nil {
+			return err
+		}
+		defer listener.Close()
+	} else if data, err = c.passive(); err != nil {
+		return err
+	}
+
+	if _, err := c.cmd(1, format, args...); err != nil {
+		if data != nil {
+			data.Close()
+		}
+		return err
+	}
+	if listener != nil {
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(c.timeout))
+		if data, err = listener.Accept(); err != nil {
+			return fmt.Errorf("server did not open the active data connection: %v", err)
+		}
+	}
+	if c.private {
+		data = tls.Client(data, c.tls)
+	}
+
+	err = fn(&ftpDataConn{Conn: data, timeout: c.timeout})
+	// Closing the data connection marks the end of an upload
+	closeErr := data.Close()
+	_, respErr := c.response(2)
+	return cmp.Or(err, closeErr, respErr)
+}
+
+// passive opens a data connection with EPSV, falling back to PASV. The
+// address in a PASV reply is ignored in favour of the control connection's
+// peer, as servers behind NAT often advertise a private address.
+func (c *ftpConn) passive() (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	var port int
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.text.PrintfLine("EPSV")
+	code, msg, err := c.text.ReadResponse(2)
+	if err == nil {
+		// 229 Entering Extended Passive Mode (|||port|)
+		_, args, _ := strings.Cut(msg, "(")
+		args, _, _ = strings.Cut(args, ")")
+		var fields []string
+		if args != "" {
+			fields = strings.Split(args, args[:1])
+		}
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("malformed EPSV reply: %s", msg)
+		}
+		port, err = strconv.Atoi(fields[3])
+	} else if code >= 500 {
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		c.text.PrintfLine("PASV")
+		if _, msg, err = c.text.ReadResponse(2); err != nil {
+			return nil, err
+		}
+		start := strings.IndexFunc(msg, func(r rune) bool { return r >= '0' && r <= '9' })
+		end := strings.LastIndexFunc(msg, func(r rune) bool { return r >= '0' && r <= '9' })
+		var fields []string
+		if start >= 0 {
+			fields = strings.Split(msg[start:end+1], ",")
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed PASV reply: %s", msg)
+		}
+		hi, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+		lo, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+		port, err = hi<<8|lo, cmp.Or(err1, err2)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), c.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open passive data connection: %v", err)
+	}
+	return data, nil
+}
+
+// port listens on the control connection's local address and announces it
+// with PORT (IPv4) or EPRT (IPv6) for an active data connection
+func (c *ftpConn) port() (net.Listener, error) {
+	host, _, err := net.SplitHostPort(c.conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for active data connection: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		_, err = c.cmd(2, "PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+	} else {
+		_, err = c.cmd(2, "EPRT |2|%s|%d|", host, port)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// store uploads r to remotePath. The upload goes to a temporary name that
+// retention does not recognise and is renamed into place once complete, so
+// an interrupted transfer never leaves a partial backup behind.
+func (c *ftpConn) store(remotePath string, r io.Reader) error {
+	tmpPath := path.Join(path.Dir(remotePath), fmt.Sprintf(".part-%s-%d", path.Base(remotePath), rand.Uint32()))
+	err := c.transfer(func(data net.Conn) error {
+		_, err := io.Copy(data, r)
+		return err
+	}, "STOR %s", tmpPath)
+	if err == nil {
+		err = c.rename(tmpPath, remotePath)
+	}
+	if err != nil {
+		c.cmd(2, "DELE %s", tmpPath)
+	}
+	return err
+}
+
+// rename moves from to to, replacing to. Servers that refuse to rename over
+// an existing file get the old copy deleted first.
+func (c *ftpConn) rename(from, to string) error {
+	try := func() error {
+		if _, err := c.cmd(3, "RNFR %s", from); err != nil {
+			return err
+		}
+		_, err := c.cmd(2, "RNTO %s", to)
+		return err
+	}
+	if err := try(); err != nil {
+		if _, delErr := c.cmd(2, "DELE %s", to); delErr != nil {
+			return err
+		}
+		return try()
+	}
+	return nil
+}
+
+// retrieve downloads remotePath into w
+func (c *ftpConn) retrieve(remotePath string, w io.Writer) error {
+	return c.transfer(func(data net.Conn) error {
+		_, err := io.Copy(w, data)
+		return err
+	}, "RETR %s", remotePath)
+}
+
+// list returns the names in dir (the login directory when empty). An empty
+// directory is reported as an error by some servers and returns no names.
+func (c *ftpConn) list(dir string) ([]string, error) {
+	var names []string
+	err := c.transfer(func(data net.Conn) error {
+		scanner := bufio.NewScanner(data)
+		for scanner.Scan() {
+			if name := strings.TrimSpace(scanner.Text()); name != "" {
+				names = append(names, name)
+			}
+		}
+		return scanner.Err()
+	}, strings.TrimSpace("NLST "+dir))
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && (protoErr.Code == 450 || protoErr.Code == 550) {
+		return nil, nil
+	}
+	return names, err
+}
+
+// delete removes remotePath
+func (c *ftpConn) delete(remotePath string) error {
+	_, err := c.cmd(2, "DELE %s", remotePath)
+	return err
+}
+
+// mkdirAll creates dir and its parents. Errors are ignored, since existing
+// directories are reported as errors too; a missing directory surfaces when
+// the upload fails.
+func (c *ftpConn) mkdirAll(dir string) {
+	prefix := ""
+	if strings.HasPrefix(dir, "/") {
+		prefix = "/"
+	}
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		prefix = path.Join(prefix, part)
+		c.cmd(2, "MKD %s", prefix)
+	}
+}
+
+func (c *ftpConn) Close() error {
+	c.cmd(2, "QUIT")
+	return c.conn.Close()
+}
+
+// ftpDataConn bounds each read and write on a data connection by the FTP
+// timeout, so a stalled transfer fails without capping large uploads
+type ftpDataConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (d *ftpDataConn) Read(p []byte) (int, error) {
+	d.Conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.Conn.Read(p)
+}
+
+func (d *ftpDataConn) Write(p []byte) (int, error) {
+	d.Conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	return d.Conn.Write(p)
+}
+
+// recordBackup adds a completed backup to the manifest, drops entries whose
+// files have aged out under the retention policy, and stores the manifest
+// locally and in S3
+func (bm *BackupManager) recordBackup(backup ManifestBackup) error {
+	bm.manifestMu.Lock()
+	defer bm.manifestMu.Unlock()
+
+	manifest, err := bm.loadManifest()
+	if err != nil {
+		return err
+	}
+	manifest.Backups = append(manifest.Backups, backup)
+
+	var names []string
+	for _, b := range manifest.Backups {
+		for _, f := range b.Files {
+			names = append(names, f.Name)
+		}
+	}
+	expired := bm.expiredBackups(names)
+
+	kept := manifest.Backups[:0]
+	for _, b := range manifest.Backups {
+		b.Files = slices.DeleteFunc(b.Files, func(f ManifestFile) bool {
+			return slices.Contains(expired, f.Name)
+		})
+		if len(b.Files) > 0 {
+			kept = append(kept, b)
+		}
+	}
+	manifest.Backups = kept
+
+	return bm.saveManifest(manifest)
+}
+
+// loadManifest reads the manifest from S3 when configured, otherwise from the
+// backup path, falling back to the FTP directory. A missing manifest is
+// returned empty.
+func (bm *BackupManager) loadManifest() (*Manifest, error) {
+	var data []byte
+	if bm.s3Svc != nil {
+		out, err := bm.s3Svc.GetObject(context.TODO(), &s3.GetObjectInput{
+			Bucket: aws.String(bm.config.S3Bucket),
+			Key:    aws.String(bm.config.S3Prefix + manifestName),
+		})
+		if err != nil {
+			var noKey *types.NoSuchKey
+			if errors.As(err, &noKey) {
+				return &Manifest{}, nil
+			}
+			return nil, fmt.Errorf("failed to download manifest: %v", err)
+		}
+		defer out.Body.Close()
+		if data, err = io.ReadAll(out.Body); err != nil {
+			return nil, fmt.Errorf("failed to download manifest: %v", err)
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(filepath.Join(bm.config.Path, manifestName))
+		if os.IsNotExist(err) && bm.config.FTPHost != "" {
+			// A new or wiped backup path picks up the copy on the FTP server
+			// rather than starting over and overwriting it
+			var buf bytes.Buffer
+			c, err := dialFTP(bm.config, bm.ftpTLS)
+			if err != nil {
+				return nil, fmt.Errorf("failed to download manifest: %v", err)
+			}
+			err = c.retrieve(bm.ftpPath(manifestName), &buf)
+			c.Close()
+			var protoErr *textproto.Error
+			if errors.As(err, &protoErr) && protoErr.Code == 550 {
+				return &Manifest{}, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to download manifest: %v", err)
+			}
+			data = buf.Bytes()
+		} else if os.IsNotExist(err) {
+			return &Manifest{}, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %v", err)
+		}
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("corrupt manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// saveManifest writes the manifest to the backup path and uploads it to S3
+// and FTP
+func (bm *BackupManager) saveManifest(manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	localPath := filepath.Join(bm.config.Path, manifestName)
+	if err := os.WriteFile(localPath+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	if err := os.Rename(localPath+".tmp", localPath); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	if bm.s3Svc != nil {
+		_, err := bm.s3Svc.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket:      aws.String(bm.config.S3Bucket),
+			Key:         aws.String(bm.config.S3Prefix + manifestName),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			return fmt.Errorf("%w: failed to upload manifest: %v", ErrUpload, err)
+		}
+	}
+	// The FTP copy lets restores fetch everything from the archive
+	if bm.config.FTPHost != "" {
+		if err := bm.storeFTP(bm.ftpPath(manifestName), bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("failed to upload manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// audit records a destructive operation and its outcome. Failures to write
+// the audit trail are logged but do not stop the operation being audited.
+func (bm *BackupManager) audit(event AuditEvent, opErr error) {
+	if bm.auditFile == nil && !bm.config.AuditS3 {
+		return
+	}
+
+	event.Time = time.Now().UTC()
+	event.Actor = bm.actor
+	event.PID = os.Getpid()
+	event.Result = "ok"
+	if opErr != nil {
+		event.Result = "failed"
+		event.Error = opErr.Error()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode audit event: %v", err)
+		return
+	}
+
+	if bm.auditFile != nil {
+		bm.auditMu.Lock()
+		_, err := bm.auditFile.Write(append(line, '\n'))
+		bm.auditMu.Unlock()
+		if err != nil {
+			log.Printf("Failed to write audit log: %v", err)
+		}
+	}
+
+	// S3 objects cannot be appended to, so each event is its own object
+	if bm.config.AuditS3 && bm.s3Svc != nil {
+		key := fmt.Sprintf("%s%s-%s-%d.json", bm.config.AuditS3Prefix,
+			event.Time.Format("2006/01/02/150405.000000000"), event.Action, rand.Uint32())
+		_, err := bm.s3Svc.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket:      aws.String(bm.config.S3Bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(line),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			log.Printf("Failed to write audit event to S3: %v", err)
+		}
+	}
+}
+
+// auditActor describes who is running the process, as user@host
+func auditActor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return name + "@" + host
+}
+
+// expiredBackups returns the files of the backups beyond the retention
+// limits, oldest first. Files are grouped by backup ID so multi-file backups
+// are kept or dropped as a whole; IDs sort chronologically because they start
+// with the timestamp. Schema artifacts are counted against MaxSchemaFiles so
+// schema history can be kept far longer than the bulky data dumps.
+func (bm *BackupManager) expiredBackups(names []string) []string {
+	sorted := slices.Clone(names)
+	slices.Sort(sorted)
+
+	groups := make(map[string][]string)
+	var schemaIDs, otherIDs []string
+	for _, name := range sorted {
+		id := backupID(name)
+		key := id
+		if isSchemaBackup(name) {
+			key += ".schema"
+			if _, ok := groups[key]; !ok {
+				schemaIDs = append(schemaIDs, key)
+			}
+		} else if _, ok := groups[key]; !ok {
+			otherIDs = append(otherIDs, key)
+		}
+		groups[key] = append(groups[key], name)
+	}
+
+	maxSchemaFiles := bm.config.MaxSchemaFiles
+	if maxSchemaFiles <= 0 {
+		maxSchemaFiles = bm.config.MaxFiles
+	}
+
+	var expired []string
+	if len(otherIDs) > bm.config.MaxFiles {
+		for _, key := range otherIDs[:len(otherIDs)-bm.config.MaxFiles] {
+			expired = append(expired, groups[key]...)
+		}
+	}
+	if len(schemaIDs) > maxSchemaFiles {
+		for _, key := range schemaIDs[:len(schemaIDs)-maxSchemaFiles] {
+			expired = append(expired, groups[key]...)
+		}
+	}
+	return expired
+}
+
+// backupID returns the backup_<timestamp>_<counter> stem shared by every file
+// of one backup
+func backupID(name string) string {
+	id, _, _ := strings.Cut(filepath.Base(name), ".")
+	return id
+}
+
+// isSchemaBackup reports whether name is a schema-only artifact
+func isSchemaBackup(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base[len(backupID(base)):], ".schema.")
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 digest of a file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// safeFileName replaces characters that are unsafe in file names and S3 keys
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || ('0' <= r && r <= '9') || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// shellQuote quotes s for safe use as a single /bin/sh word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Encrypted files are a chunked AES-256-GCM stream (the STREAM construction):
+// a header of encMagic and a random nonce prefix, then length-prefixed sealed
+// chunks. Each chunk nonce is the prefix, a big-endian chunk counter and a
+// final-chunk flag, so reordered, dropped or truncated chunks fail to open.
+const (
+	encAlgorithm = "AES-256-GCM-STREAM"
+	encMagic     = "GDBENC01"
+	encChunkSize = 64 * 1024
+	encPrefixLen = 7
+
+	keyRecordSuffix = ".keys"
+)
+
+// keyWrapper wraps and unwraps data keys under one key-encryption key
+type keyWrapper interface {
+	ID() string
+	Wrap(dataKey []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// keyring holds the keys that wrap new data keys (recipients) and every key
+// known for unwrapping, current and retired, by ID
+type keyring struct {
+	recipients []keyWrapper
+	byID       map[string]keyWrapper
+}
+
+// loadKeyring parses file: and kms: key specifications
+func loadKeyring(current, retired []string, kmsRegion string) (*keyring, error) {
+	kr := &keyring{byID: make(map[string]keyWrapper)}
+	var kmsClient *kms.Client
+
+	load := func(spec string) (keyWrapper, error) {
+		kind, ref, ok := strings.Cut(spec, ":")
+		if !ok || ref == "" {
+			return nil, fmt.Errorf("invalid encryption key %q: expected file:<path> or kms:<key-id>", spec)
+		}
+		switch kind {
+		case "file":
+			return loadFileKey(ref)
+		case "kms":
+			if kmsClient == nil {
+				opts := []func(*config.LoadOptions) error{}
+				if kmsRegion != "" {
+					opts = append(opts, config.WithRegion(kmsRegion))
+				}
+				cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+				if err != nil {
+					return nil, fmt.Errorf("failed to load AWS config for KMS: %v", err)
+				}
+				kmsClient = kms.NewFromConfig(cfg)
+			}
+			return &kmsKey{keyID: ref, client: kmsClient}, nil
+		default:
+			return nil, fmt.Errorf("invalid encryption key %q: unknown key type %s", spec, kind)
+		}
+	}
+
+	for _, spec := range current {
+		key, err := load(spec)
+		if err != nil {
+			return nil, err
+		}
+		kr.recipients = append(kr.recipients, key)
+		kr.byID[key.ID()] = key
+	}
+	for _, spec := range retired {
+		key, err := load(spec)
+		if err != nil {
+			return nil, err
+		}
+		kr.byID[key.ID()] = key
+	}
+	return kr, nil
+}
+
+// wrap wraps a data key for every recipient
+func (kr *keyring) wrap(dataKey []byte) ([]WrappedKey, error) {
+	wrapped := make([]WrappedKey, 0, len(kr.recipients))
+	for _, key := range kr.recipients {
+		ciphertext, err := key.Wrap(dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap data key for %s: %v", key.ID(), err)
+		}
+		wrapped = append(wrapped, WrappedKey{KeyID: key.ID(), DataKey: ciphertext})
+	}
+	return wrapped, nil
+}
+
+// unwrap recovers a data key with the first available key it was wrapped for
+func (kr *keyring) unwrap(wrapped []WrappedKey) ([]byte, error) {
+	var ids []string
+	for _, w := range wrapped {
+		ids = append(ids, w.KeyID)
+		key, ok := kr.byID[w.KeyID]
+		if !ok {
+			continue
+		}
+		dataKey, err := key.Unwrap(w.DataKey)
+		if err != nil {
+			log.Printf("Failed to unwrap data key with %s: %v", w.KeyID, err)
+			continue
+		}
+		return dataKey, nil
+	}
+	return nil, fmt.Errorf("none of the configured keys can decrypt this backup; it needs one of: %s", strings.Join(ids, ", "))
+}
+
+// fileKey is a 256-bit key read from a local file. Its ID is derived from a
+// fingerprint of the key, so it does not depend on where the file lives.
+type fileKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// loadFileKey reads a 32-byte key stored raw, base64 or hex encoded
+func loadFileKey(path string) (*fileKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %v", err)
+	}
+
+	key := data
+	if len(key) != 32 {
+		text := strings.TrimSpace(string(data))
+		if decoded, err := base64.StdEncoding.DecodeString(text); err == nil && len(decoded) == 32 {
+			key = decoded
+		} else if decoded, err := hex.DecodeString(text); err == nil && len(decoded) == 32 {
+			key = decoded
+		} else {
+			return nil, fmt.Errorf("encryption key %s must hold 32 bytes, raw, base64 or hex encoded", path)
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(key)
+	return &fileKey{id: "file:" + hex.EncodeToString(fingerprint[:8]), aead: aead}, nil
+}
+
+func (k *fileKey) ID() string { return k.id }
+
+func (k *fileKey) Wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, dataKey, []byte(k.id)), nil
+}
+
+func (k *fileKey) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	nonce, ciphertext := wrapped[:k.aead.NonceSize()], wrapped[k.aead.NonceSize():]
+	return k.aead.Open(nil, nonce, ciphertext, []byte(k.id))
+}
+
+// kmsKey wraps data keys with AWS KMS Encrypt and Decrypt
+type kmsKey struct {
+	keyID  string
+	client *kms.Client
+}
+
+func (k *kmsKey) ID() string { return "kms:" + k.keyID }
+
+func (k *kmsKey) Wrap(dataKey []byte) ([]byte, error) {
+	out, err := k.client.Encrypt(context.TODO(), &kms.EncryptInput{
+		KeyId:     aws.String(k.keyID),
+		Plaintext: dataKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+func (k *kmsKey) Unwrap(wrapped []byte) ([]byte, error) {
+	out, err := k.client.Decrypt(context.TODO(), &kms.DecryptInput{
+		KeyId:          aws.String(k.keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// encryptArtifact encrypts path to path+".enc" under a fresh data key and
+// removes the plaintext
+func (bm *BackupManager) encryptArtifact(path string) (*FileEncryption, error) {
+	dataKey := make([]byte, 32)
+	if _, err := crand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := bm.keys.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encryption := &FileEncryption{Algorithm: encAlgorithm, Keys: wrapped}
+	if err := writeKeyRecord(path+".enc", encryption); err != nil {
+		return nil, err
+	}
+	if err := encryptFile(path, path+".enc", dataKey); err != nil {
+		os.Remove(path + ".enc")
+		os.Remove(path + ".enc" + keyRecordSuffix)
+		return nil, fmt.Errorf("failed to encrypt %s: %v", filepath.Base(path), err)
+	}
+	os.Remove(path)
+
+	return encryption, nil
+}
+
+// writeKeyRecord writes the key record for the encrypted file at path
+func writeKeyRecord(path string, encryption *FileEncryption) error {
+	data, err := json.MarshalIndent(encryption, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+keyRecordSuffix, data, 0600); err != nil {
+		return fmt.Errorf("failed to write key record: %v", err)
+	}
+	return nil
+}
+
+// readKeyRecord reads the key record for the encrypted file at localPath,
+// downloading it from S3 or FTP when it is not present locally
+func (bm *BackupManager) readKeyRecord(localPath string) (*FileEncryption, error) {
+	name := filepath.Base(localPath) + keyRecordSuffix
+	src, err := bm.openBackupFile(localPath+keyRecordSuffix, &ManifestFile{
+		S3Key:   bm.config.S3Prefix + name,
+		FTPPath: bm.ftpPath(name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("no key record for %s: %v", filepath.Base(localPath), err)
+	}
+	defer src.Close()
+
+	var encryption FileEncryption
+	if err := json.NewDecoder(src).Decode(&encryption); err != nil {
+		return nil, fmt.Errorf("corrupt key record %s: %v", name, err)
+	}
+	return &encryption, nil
+}
+
+// saveKeyRecord replaces a key record wherever it is stored: locally when a
+// copy is present or no remote storage is configured, and in S3 and FTP
+func (bm *BackupManager) saveKeyRecord(name string, encryption *FileEncryption) error {
+	data, err := json.MarshalIndent(encryption, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	localPath := filepath.Join(bm.config.Path, name)
+	if _, err := os.Stat(localPath); err == nil || (bm.s3Svc == nil && bm.config.FTPHost == "") {
+		if err := os.WriteFile(localPath+".tmp", data, 0600); err != nil {
+			return fmt.Errorf("failed to write key record: %v", err)
+		}
+		if err := os.Rename(localPath+".tmp", localPath); err != nil {
+			return fmt.Errorf("failed to write key record: %v", err)
+		}
+	}
+	if bm.s3Svc != nil {
+		_, err := bm.s3Svc.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket:      aws.String(bm.config.S3Bucket),
+			Key:         aws.String(bm.config.S3Prefix + name),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("application/json"),
+		})
+		if err != nil {
+			return fmt.Errorf("%w: failed to upload key record %s: %v", ErrUpload, name, err)
+		}
+	}
+	if bm.config.FTPHost != "" {
+		if err := bm.storeFTP(bm.ftpPath(name), bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("failed to upload key record: %w", err)
+		}
+	}
+	return nil
+}
+
+// listKeyRecords returns the names of the key records in the backup path and
+// in remote storage (S3 when configured, otherwise FTP)
+func (bm *BackupManager) listKeyRecords() ([]string, error) {
+	var names []string
+	entries, err := os.ReadDir(bm.config.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read backup directory: %v", err)
+	}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	if bm.s3Svc != nil {
+		keys, err := bm.listS3Objects()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			names = append(names, path.Base(key))
+		}
+	} else if bm.config.FTPHost != "" {
+		c, err := dialFTP(bm.config, bm.ftpTLS)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		remote, err := c.list(bm.ftpDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list FTP directory: %v", err)
+		}
+		for _, name := range remote {
+			names = append(names, path.Base(name))
+		}
+	}
+
+	names = slices.DeleteFunc(names, func(name string) bool {
+		return !strings.HasSuffix(name, keyRecordSuffix) || !isBackupFile(name)
+	})
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+// encryptFile writes the encrypted form of srcPath to dstPath
+func encryptFile(srcPath, dstPath string, dataKey []byte) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	aead, err := newStreamAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, encPrefixLen)
+	if _, err := crand.Read(prefix); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(dst)
+	w.WriteString(encMagic)
+	w.Write(prefix)
+
+	r := bufio.NewReader(src)
+	chunk := make([]byte, encChunkSize)
+	sealed := make([]byte, 0, encChunkSize+aead.Overhead())
+	var length [4]byte
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, peekErr := r.Peek(1)
+		if peekErr != nil && peekErr != io.EOF {
+			return peekErr
+		}
+		last := peekErr == io.EOF
+
+		sealed = aead.Seal(sealed[:0], chunkNonce(prefix, counter, last), chunk[:n], nil)
+		binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+		w.Write(length[:])
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+// decryptStream decrypts an encrypted backup from r into w
+func decryptStream(r io.Reader, w io.Writer, dataKey []byte) error {
+	aead, err := newStreamAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	header := make([]byte, len(encMagic)+encPrefixLen)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return fmt.Errorf("not an encrypted backup")
+	}
+	prefix := header[len(encMagic):]
+
+	chunk := make([]byte, encChunkSize+aead.Overhead())
+	var length [4]byte
+	for counter := uint32(0); ; counter++ {
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return fmt.Errorf("encrypted backup is truncated")
+		}
+		n := int(binary.BigEndian.Uint32(length[:]))
+		if n > len(chunk) {
+			return fmt.Errorf("encrypted backup is corrupt")
+		}
+		if _, err := io.ReadFull(br, chunk[:n]); err != nil {
+			return fmt.Errorf("encrypted backup is truncated")
+		}
+		_, peekErr := br.Peek(1)
+		last := peekErr == io.EOF
+
+		plaintext, err := aead.Open(chunk[:0], chunkNonce(prefix, counter, last), chunk[:n], nil)
+		if err != nil {
+			return fmt.Errorf("encrypted backup is corrupt or truncated")
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func newStreamAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce builds the 12-byte nonce for chunk counter of a stream
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, encPrefixLen+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixLen:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// DecryptBackup decrypts an encrypted backup file, unwrapping its data key
+// from the file's key record. When backupFile or its key record does not
+// exist locally it is fetched from S3 or FTP. output defaults to the file
+// name without the .enc suffix.
+func (bm *BackupManager) DecryptBackup(backupFile, output string) error {
+	if bm.keys == nil {
+		return fmt.Errorf("no keys configured; set -encrypt-keys or -retired-keys")
+	}
+
+	name := filepath.Base(backupFile)
+	encryption, err := bm.readKeyRecord(backupFile)
+	if err != nil {
+		return err
+	}
+
+	dataKey, err := bm.keys.unwrap(encryption.Keys)
+	if err != nil {
+		return err
+	}
+
+	src, err := bm.openBackupFile(backupFile, &ManifestFile{
+		S3Key:   bm.config.S3Prefix + name,
+		FTPPath: bm.ftpPath(name),
+	})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if output == "" {
+		output = strings.TrimSuffix(backupFile, ".enc")
+	}
+	dst, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("failed to create output: %v", err)
+	}
+	defer dst.Close()
+
+	if err := decryptStream(src, dst, dataKey); err != nil {
+		os.Remove(output)
+		return err
+	}
+	log.Printf("Decrypted %s to %s", name, output)
+	return dst.Close()
+}
+
+// openBackupFile opens localPath, or downloads the file from S3 or FTP using
+// the location in entry when it is not present locally
+func (bm *BackupManager) openBackupFile(localPath string, entry *ManifestFile) (io.ReadCloser, error) {
+	file, err := os.Open(localPath)
+	if err == nil {
+		return file, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open backup: %v", err)
+	}
+
+	switch {
+	case bm.s3Svc != nil && entry.S3Key != "":
+		out, err := bm.s3Svc.GetObject(context.TODO(), &s3.GetObjectInput{
+			Bucket: aws.String(bm.config.S3Bucket),
+			Key:    aws.String(entry.S3Key),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %v", entry.S3Key, err)
+		}
+		return out.Body, nil
+	case bm.config.FTPHost != "" && entry.FTPPath != "":
+		c, err := dialFTP(bm.config, bm.ftpTLS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %v", entry.FTPPath, err)
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			defer c.Close()
+			pw.CloseWithError(c.retrieve(entry.FTPPath, pw))
+		}()
+		return pr, nil
+	default:
+		return nil, fmt.Errorf("failed to open backup: %v", err)
+	}
+}
+
+// RotateKeys re-wraps the data key of every encrypted backup for the current
+// EncryptionKeys, rewriting the key records in the backup path, S3 and FTP and
+// refreshing the manifest index. Backup files are not touched; keys that are
+// no longer listed lose access once the records are saved. It returns the
+// number of files re-wrapped.
+func (bm *BackupManager) RotateKeys() (int, error) {
+	if bm.keys == nil || len(bm.keys.recipients) == 0 {
+		return 0, fmt.Errorf("no encryption keys configured; set -encrypt-keys to the new key set")
+	}
+
+	names, err := bm.listKeyRecords()
+	if err != nil {
+		return 0, err
+	}
+
+	var want []string
+	for _, key := range bm.keys.recipients {
+		want = append(want, key.ID())
+	}
+
+	rotated := 0
+	records := make(map[string]*FileEncryption)
+	for _, name := range names {
+		fileName := strings.TrimSuffix(name, keyRecordSuffix)
+		encryption, err := bm.readKeyRecord(filepath.Join(bm.config.Path, fileName))
+		if err != nil {
+			return rotated, err
+		}
+		records[fileName] = encryption
+
+		var have []string
+		for _, w := range encryption.Keys {
+			have = append(have, w.KeyID)
+		}
+		if slices.Equal(have, want) {
+			continue
+		}
+
+		dataKey, err := bm.keys.unwrap(encryption.Keys)
+		if err != nil {
+			return rotated, fmt.Errorf("%s: %v", fileName, err)
+		}
+		if encryption.Keys, err = bm.keys.wrap(dataKey); err != nil {
+			return rotated, err
+		}
+		if err := bm.saveKeyRecord(name, encryption); err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+
+	// Bring the manifest index in line with the records
+	bm.manifestMu.Lock()
+	defer bm.manifestMu.Unlock()
+
+	manifest, err := bm.loadManifest()
+	if err != nil {
+		return rotated, err
+	}
+	changed := false
+	for i := range manifest.Backups {
+		for j := range manifest.Backups[i].Files {
+			file := &manifest.Backups[i].Files[j]
+			if encryption, ok := records[file.Name]; ok && !reflect.DeepEqual(file.Encryption, encryption) {
+				file.Encryption = encryption
+				changed = true
+			}
+		}
+	}
+	if changed {
+		if err := bm.saveManifest(manifest); err != nil {
+			return rotated, err
+		}
+	}
+	return rotated, nil
+}
+
+// Names of the metadata entries at the start of an export archive
+const (
+	exportSums      = "SHA256SUMS"
+	exportSignature = "SHA256SUMS.sig"
+)
+
+// ExportBackups writes the backups with the given IDs, or every backup in the
+// manifest when ids is empty, to a tar archive for transfer to another site.
+// The archive starts with SHA256SUMS (in sha256sum format) covering the
+// manifest subset and every file, its Ed25519 signature made with the
+// PKCS#8 PEM key in signKeyFile, and manifest.json, followed by the backup
+// files. Files are read locally or downloaded from S3/FTP and checked against
+// the manifest on the way. It returns the number of backups exported.
+func (bm *BackupManager) ExportBackups(ids []string, output, signKeyFile string) (int, error) {
+	signKey, err := loadSigningKey(signKeyFile)
+	if err != nil {
+		return 0, err
+	}
+
+	manifest, err := bm.loadManifest()
+	if err != nil {
+		return 0, err
+	}
+	subset := &Manifest{}
+	for _, b := range manifest.Backups {
+		if len(ids) == 0 || slices.Contains(ids, b.ID) {
+			subset.Backups = append(subset.Backups, b)
+		}
+	}
+	for _, id := range ids {
+		if !slices.ContainsFunc(subset.Backups, func(b ManifestBackup) bool { return b.ID == id }) {
+			return 0, fmt.Errorf("backup %s not found in the manifest", id)
+		}
+	}
+	if len(subset.Backups) == 0 {
+		return 0, fmt.Errorf("no backups to export")
+	}
+
+	// The key records are authoritative; carry them in the signed manifest so
+	// the importing site can recreate them
+	for i := range subset.Backups {
+		files := slices.Clone(subset.Backups[i].Files)
+		for j := range files {
+			if !strings.HasSuffix(files[j].Name, ".enc") {
+				continue
+			}
+			if files[j].Encryption, err = bm.readKeyRecord(filepath.Join(bm.config.Path, files[j].Name)); err != nil {
+				return 0, err
+			}
+		}
+		subset.Backups[i].Files = files
+	}
+
+	manifestData, err := json.MarshalIndent(subset, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	var sums bytes.Buffer
+	fmt.Fprintf(&sums, "%x  %s\n", sha256.Sum256(manifestData), manifestName)
+	for _, b := range subset.Backups {
+		for _, f := range b.Files {
+			fmt.Fprintf(&sums, "%s  %s\n", f.SHA256, f.Name)
+		}
+	}
+	signature := ed25519.Sign(signKey, sums.Bytes())
+
+	out, err := os.Create(output)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create export archive: %v", err)
+	}
+	defer out.Close()
+
+	if err := bm.writeExport(out, subset, manifestData, sums.Bytes(), signature); err != nil {
+		out.Close()
+		os.Remove(output)
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(output)
+		return 0, fmt.Errorf("failed to write export archive: %v", err)
+	}
+	return len(subset.Backups), nil
+}
+
+// writeExport writes the tar stream of an export archive
+func (bm *BackupManager) writeExport(w io.Writer, subset *Manifest, manifestData, sums, signature []byte) error {
+	tw := tar.NewWriter(w)
+	now := time.Now().Truncate(time.Second)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{exportSums, sums}, {exportSignature, signature}, {manifestName, manifestData}} {
+		hdr := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write export archive: %v", err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return fmt.Errorf("failed to write export archive: %v", err)
+		}
+	}
+
+	for _, b := range subset.Backups {
+		for _, f := range b.Files {
+			src, err := bm.openBackupFile(filepath.Join(bm.config.Path, f.Name), &f)
+			if err != nil {
+				return err
+			}
+			hdr := &tar.Header{Name: f.Name, Mode: 0644, Size: f.Size, ModTime: b.CreatedAt.Truncate(time.Second)}
+			if err := tw.WriteHeader(hdr); err != nil {
+				src.Close()
+				return fmt.Errorf("failed to write export archive: %v", err)
+			}
+			hash := sha256.New()
+			_, err = io.Copy(tw, io.TeeReader(src, hash))
+			src.Close()
+			if err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrVerification, f.Name, err)
+			}
+			if hex.EncodeToString(hash.Sum(nil)) != f.SHA256 {
+				return fmt.Errorf("%w: %s does not match its manifest checksum", ErrVerification, f.Name)
+			}
+			log.Printf("Exported %s (%s)", f.Name, formatBytes(f.Size))
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write export archive: %v", err)
+	}
+	return nil
+}
+
+// ImportBackups verifies an archive written by ExportBackups against the
+// PKIX PEM public key in verifyKeyFile and ingests its backups like freshly
+// taken ones: files are uploaded to S3/FTP when configured, otherwise kept in
+// the backup path, and the backups are merged into the manifest. The whole
+// archive is verified before anything is written. Backups already in the
+// manifest are skipped. It returns the number of backups imported.
+func (bm *BackupManager) ImportBackups(archive, verifyKeyFile string) (int, error) {
+	verifyKey, err := loadVerifyKey(verifyKeyFile)
+	if err != nil {
+		return 0, err
+	}
 
-					// Optionally delete local file after successful upload to save space
-					os.Remove(checkPath)
-				}
-			}
-		}
+	// First pass: signature, checksums and completeness
+	imported, err := readExport(archive, verifyKey, nil)
+	if err != nil {
+		return 0, err
+	}
 
-		// Clean up old backups
-		if bm.config.S3Bucket != "" {
-			bm.cleanupOldBackupsS3()
-		} else {
-			bm.cleanupOldBackups()
+	existing, err := bm.loadManifest()
+	if err != nil {
+		return 0, err
+	}
+	skip := make(map[string]bool)
+	for _, b := range imported.Backups {
+		if slices.ContainsFunc(existing.Backups, func(e ManifestBackup) bool { return e.ID == b.ID }) {
+			log.Printf("Skipping %s, already in the manifest", b.ID)
+			skip[b.ID] = true
 		}
-
-		// Sleep for the specified interval
-		time.Sleep(bm.config.Interval)
-		counter++
 	}
-}
 
-// performBackup executes the actual database backup
-func (bm *BackupManager) performBackup(outputPath string) error {
-	var cmd string
+	if err := os.MkdirAll(bm.config.Path, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create backup directory: %v", err)
+	}
 
-	switch bm.config.Connection {
-	case "mysql", "mariadb":
-		// Check if mariadb-dump exists first
-		if _, err := exec.LookPath("mariadb-dump"); err == nil {
-			cmd = fmt.Sprintf("mariadb-dump --host=%s --port=%s --user=%s --password=%s --single-transaction --routines --triggers %s",
-				bm.config.DBHost, bm.config.DBPort, bm.config.DBUser, bm.config.DBPassword, bm.config.DBName)
-		} else if _, err := exec.LookPath("mysqldump"); err == nil {
-			// Fallback to mysqldump
-			cmd = fmt.Sprintf("mysqldump --host=%s --port=%s --user=%s --password=%s --single-transaction --routines --triggers %s",
-				bm.config.DBHost, bm.config.DBPort, bm.config.DBUser, bm.config.DBPassword, bm.config.DBName)
-		} else {
-			return fmt.Errorf("neither mariadb-dump nor mysqldump found in PATH")
+	// Second pass: store each file, checking it again as it is written. The
+	// returned manifest carries the new S3/FTP locations.
+	imported, err = readExport(archive, verifyKey, func(b *ManifestBackup, f *ManifestFile, r io.Reader) error {
+		if skip[b.ID] {
+			_, err := io.Copy(io.Discard, r)
+			return err
 		}
-	case "postgres", "postgresql":
-		cmd = fmt.Sprintf("pg_dump --host=%s --port=%s --username=%s --dbname=%s",
-			bm.config.DBHost, bm.config.DBPort, bm.config.DBUser, bm.config.DBName)
-		// Set PGPASSWORD environment variable for pg_dump
-		os.Setenv("PGPASSWORD", bm.config.DBPassword)
-	case "redis":
-		// For Redis, we use redis-cli to trigger a save and then copy the dump file
-		// Note: This is a simplified approach. For production Redis, you might want to use BGSAVE
-		// and then copy the dump.rdb file, or use --rdb flag if available in newer redis-cli versions.
-		// Here we use the --rdb flag which dumps the RDB file to stdout
+		return bm.importFile(b.ID, f, r)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	bm.manifestMu.Lock()
+	defer bm.manifestMu.Unlock()
 
-		// If password is provided, set REDISCLI_AUTH environment variable
-		// This avoids the warning about using password on command line
-		if bm.config.DBPassword != "" {
-			os.Setenv("REDISCLI_AUTH", bm.config.DBPassword)
+	manifest, err := bm.loadManifest()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, b := range imported.Backups {
+		if !skip[b.ID] {
+			manifest.Backups = append(manifest.Backups, b)
+			count++
 		}
+	}
+	slices.SortStableFunc(manifest.Backups, func(a, b ManifestBackup) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return count, bm.saveManifest(manifest)
+}
 
-		// redis-cli --rdb - (dash) writes to stdout
-		cmd = fmt.Sprintf("redis-cli -h %s -p %s --rdb -",
-			bm.config.DBHost, bm.config.DBPort)
+// importFile writes one imported file to the backup path, checks it and
+// stores it like a new backup file, updating its recorded locations
+func (bm *BackupManager) importFile(id string, f *ManifestFile, r io.Reader) error {
+	tmp, err := os.CreateTemp(bm.config.Path, ".import-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", f.Name, err)
+	}
+	defer os.Remove(tmp.Name())
 
-	default:
-		return fmt.Errorf("unsupported database connection: %s", bm.config.Connection)
+	hash := sha256.New()
+	_, err = io.Copy(tmp, io.TeeReader(r, hash))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", f.Name, err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != f.SHA256 {
+		return fmt.Errorf("%w: %s does not match its checksum", ErrVerification, f.Name)
 	}
 
-	// Add compression if needed
-	if bm.config.Gzip {
-		cmd += fmt.Sprintf(" | gzip > %s", outputPath+".gz")
-		// Note: We don't update outputPath here because it's passed by value
-		// The caller needs to know to look for .gz extension
-	} else {
-		cmd += fmt.Sprintf(" > %s", outputPath)
+	localPath := filepath.Join(bm.config.Path, f.Name)
+	if err := os.Rename(tmp.Name(), localPath); err != nil {
+		return fmt.Errorf("failed to write %s: %v", f.Name, err)
 	}
+	log.Printf("Imported %s (%s)", f.Name, formatBytes(f.Size))
 
-	// Add optimization if needed
-	if bm.config.Optimize {
-		cmd = "nice -n19 ionice -c3 " + cmd
+	// Recreate the key record from the signed manifest, ahead of the file
+	if f.Encryption != nil {
+		if err := writeKeyRecord(localPath, f.Encryption); err != nil {
+			return err
+		}
+		if err := bm.storeRemote(id, localPath+keyRecordSuffix, &ManifestFile{}); err != nil {
+			return err
+		}
 	}
 
-	// Execute the command
-	return executeCommand(cmd)
+	// Locations on the exporting site mean nothing here
+	f.S3Key, f.FTPPath = "", ""
+	return bm.storeRemote(id, localPath, f)
 }
 
-// uploadToS3 uploads the backup file to S3
-func (bm *BackupManager) uploadToS3(filePath, s3Key string) error {
-	file, err := os.Open(filePath)
+// readExport reads an export archive, checking the signature over SHA256SUMS,
+// the manifest against it, and every file against both. With a non-nil
+// ingest, each file is handed to it as it is read. Any mismatch, unknown or
+// missing entry fails with ErrVerification. It returns the archive's manifest.
+func readExport(archive string, verifyKey ed25519.PublicKey, ingest func(*ManifestBackup, *ManifestFile, io.Reader) error) (*Manifest, error) {
+	file, err := os.Open(archive)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
+		return nil, fmt.Errorf("failed to open export archive: %v", err)
 	}
 	defer file.Close()
+	tr := tar.NewReader(file)
 
-	_, err = bm.s3Svc.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(bm.config.S3Bucket),
-		Key:    aws.String(s3Key),
-		Body:   file,
-	})
-
-	if err != nil {
-		return fmt.Errorf("failed to upload to S3: %v", err)
+	// The metadata entries come first and are small
+	var meta [3][]byte
+	for i, name := range []string{exportSums, exportSignature, manifestName} {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil, fmt.Errorf("%w: not an export archive: %v", ErrVerification, err)
+		}
+		if hdr.Name != name || hdr.Size > 64<<20 {
+			return nil, fmt.Errorf("%w: not an export archive: expected %s, found %s", ErrVerification, name, hdr.Name)
+		}
+		if meta[i], err = io.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrVerification, err)
+		}
 	}
+	sums, signature, manifestData := meta[0], meta[1], meta[2]
 
-	return nil
-}
-
-// cleanupOldBackups removes old backup files locally
-func (bm *BackupManager) cleanupOldBackups() {
-	files, err := filepath.Glob(filepath.Join(bm.config.Path, "backup_*"))
-	if err != nil {
-		log.Printf("Error finding backup files: %v", err)
-		return
+	if !ed25519.Verify(verifyKey, sums, signature) {
+		return nil, fmt.Errorf("%w: signature does not match the verification key", ErrVerification)
 	}
 
-	// Filter files to only include backup files
-	var backupFiles []string
-	for _, file := range files {
-		base := filepath.Base(file)
-		if strings.Contains(base, "backup_") && (strings.HasSuffix(base, ".sql") || strings.HasSuffix(base, ".sql.gz") || strings.HasSuffix(base, ".rdb") || strings.HasSuffix(base, ".rdb.gz")) {
-			backupFiles = append(backupFiles, file)
+	want := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(sums)), "\n") {
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok || name != filepath.Base(name) || (name != manifestName && !isBackupFile(name)) {
+			return nil, fmt.Errorf("%w: malformed %s line: %s", ErrVerification, exportSums, line)
 		}
+		want[name] = sum
 	}
+	if fmt.Sprintf("%x", sha256.Sum256(manifestData)) != want[manifestName] {
+		return nil, fmt.Errorf("%w: %s does not match its checksum", ErrVerification, manifestName)
+	}
+	delete(want, manifestName)
 
-	// Sort files by name (which includes timestamp, so chronological order)
-	// In a real implementation, you'd want to sort by modification time
-	// For simplicity, we'll just remove the oldest files
-	if len(backupFiles) <= bm.config.MaxFiles {
-		return
+	var manifest Manifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: corrupt manifest: %v", ErrVerification, err)
+	}
+	files := make(map[string]*ManifestFile)
+	owners := make(map[string]*ManifestBackup)
+	for i := range manifest.Backups {
+		for j := range manifest.Backups[i].Files {
+			f := &manifest.Backups[i].Files[j]
+			if want[f.Name] != f.SHA256 {
+				return nil, fmt.Errorf("%w: %s is not listed in %s", ErrVerification, f.Name, exportSums)
+			}
+			files[f.Name] = f
+			owners[f.Name] = &manifest.Backups[i]
+		}
+	}
+	if len(files) != len(want) {
+		return nil, fmt.Errorf("%w: %s lists files missing from the manifest", ErrVerification, exportSums)
 	}
 
-	// Sort by name (which contains timestamp)
-	// In a real implementation, you'd want to sort by actual timestamp
-	// For this example, we'll just remove the first N files that exceed MaxFiles
-	for i := 0; i < len(backupFiles)-bm.config.MaxFiles; i++ {
-		err := os.Remove(backupFiles[i])
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			log.Printf("Failed to delete old backup: %v", err)
-		} else {
-			log.Printf("Deleted old backup: %s", filepath.Base(backupFiles[i]))
+			return nil, fmt.Errorf("%w: %v", ErrVerification, err)
+		}
+		f, ok := files[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected or duplicate entry %s", ErrVerification, hdr.Name)
+		}
+		delete(files, hdr.Name)
+
+		hash := sha256.New()
+		r := io.TeeReader(tr, hash)
+		if ingest != nil {
+			err = ingest(owners[hdr.Name], f, r)
+		} else if _, err = io.Copy(io.Discard, r); err != nil {
+			err = fmt.Errorf("%w: %s: %v", ErrVerification, hdr.Name, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != want[hdr.Name] {
+			return nil, fmt.Errorf("%w: %s does not match its checksum", ErrVerification, hdr.Name)
 		}
 	}
-}
 
-// cleanupOldBackupsS3 removes old backup files from S3
-func (bm *BackupManager) cleanupOldBackupsS3() {
-	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(bm.config.S3Bucket),
-		Prefix: aws.String(bm.config.S3Prefix),
+	for name := range files {
+		return nil, fmt.Errorf("%w: archive is missing %s", ErrVerification, name)
 	}
+	return &manifest, nil
+}
 
-	result, err := bm.s3Svc.ListObjectsV2(context.TODO(), input)
+// loadSigningKey reads an Ed25519 private key in PKCS#8 PEM form, as written
+// by `openssl genpkey -algorithm ed25519`
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no signing key configured; set -sign-key")
+	}
+	block, err := readPEM(path)
 	if err != nil {
-		log.Printf("Failed to list S3 objects: %v", err)
-		return
+		return nil, err
 	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %v", path, err)
+	}
+	signKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", path)
+	}
+	return signKey, nil
+}
 
-	// Filter for backup files
-	var backupObjects []types.Object
-
-	for _, obj := range result.Contents {
-		if obj.Key != nil && strings.Contains(*obj.Key, "backup_") {
-			key := *obj.Key
-			if strings.HasSuffix(key, ".sql") || strings.HasSuffix(key, ".sql.gz") || strings.HasSuffix(key, ".rdb") || strings.HasSuffix(key, ".rdb.gz") {
-				backupObjects = append(backupObjects, obj)
-			}
-		}
+// loadVerifyKey reads an Ed25519 public key in PKIX PEM form, as written by
+// `openssl pkey -pubout`
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no verification key configured; set -verify-key")
+	}
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verification key %s: %v", path, err)
+	}
+	verifyKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("verification key %s is not an Ed25519 key", path)
 	}
+	return verifyKey, nil
+}
 
-	// Sort by LastModified (oldest first)
-	// In a real implementation, you'd sort the objects by LastModified
-	if len(backupObjects) <= bm.config.MaxFiles {
-		return
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
 	}
+	return block, nil
+}
 
-	// Delete oldest files if we have more than MaxFiles
-	for i := 0; i < len(backupObjects)-bm.config.MaxFiles; i++ {
-		_, err := bm.s3Svc.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-			Bucket: aws.String(bm.config.S3Bucket),
-			Key:    backupObjects[i].Key,
-		})
+// defaultRestoreScript is the built-in restore script template. BT holds a
+// backtick for MySQL identifiers, which cannot appear in this raw string.
+const defaultRestoreScript = `#!/bin/sh
+# Restore script for backup {{.Backup.ID}}
+# {{.Backup.Connection}}{{if .Backup.Database}} database {{.Backup.Database}}{{end}}, taken {{.Backup.CreatedAt.Format "2006-01-02 15:04:05 MST"}}
+#
+# Run from a scratch directory on a host with the database client tools{{if .S3Bucket}},
+# the AWS CLI{{else if .FTPURL}}, curl{{end}}{{if .Encrypted}}, the db-backup binary and a key listed in the manifest{{end}}.
+# Every setting below can be overridden from the environment, for example:
+#
+#   DB_HOST=10.0.0.5 DB_ADMIN_PASSWORD=secret ./{{.Backup.ID}}.restore.sh
+set -eu
 
-		if err != nil {
-			log.Printf("Failed to delete old backup from S3: %v", err)
-		} else {
-			log.Printf("Deleted old backup from S3: %s", *backupObjects[i].Key)
-		}
-	}
+DB_HOST=${DB_HOST:-{{sh .DBHost}}}
+DB_PORT=${DB_PORT:-{{sh .DBPort}}}
+{{- if ne .Engine "redis"}}
+DB_NAME=${DB_NAME:-{{sh .Backup.Database}}}
+DB_ADMIN_USER=${DB_ADMIN_USER:-{{if eq .Engine "postgres"}}postgres{{else}}root{{end}}}
+DB_ADMIN_PASSWORD=${DB_ADMIN_PASSWORD:-}
+# Application user granted access to the restored database; APP_PASSWORD
+# creates it if it does not exist yet
+APP_USER=${APP_USER:-{{sh .DBUser}}}
+APP_PASSWORD=${APP_PASSWORD:-}
+{{- else}}
+REDIS_PASSWORD=${REDIS_PASSWORD:-}
+{{- end}}
+{{- if .S3Bucket}}
+S3_BUCKET=${S3_BUCKET:-{{sh .S3Bucket}}}
+S3_REGION=${S3_REGION:-{{sh .S3Region}}}
+S3_ENDPOINT=${S3_ENDPOINT:-{{sh .S3Endpoint}}}
+{{- else if .FTPURL}}
+FTP_URL=${FTP_URL:-{{sh .FTPURL}}}
+FTP_USER=${FTP_USER:-{{sh .FTPUser}}}
+FTP_PASSWORD=${FTP_PASSWORD:-}
+{{- end}}
+{{- if .Encrypted}}
+# Keys for db-backup decrypt, e.g. kms:alias/db-backups or file:/path/to/key
+DB_BACKUP=${DB_BACKUP:-db-backup}
+BACKUP_KEYS=${BACKUP_KEYS:?set BACKUP_KEYS to a key that can decrypt this backup}
+{{- end}}
+
+# fetch downloads a backup file unless it is already present
+fetch() {
+	[ -f "$1" ] && return 0
+{{- if .S3Bucket}}
+	echo "Downloading $1"
+	aws s3 cp "s3://$S3_BUCKET/$2" "$1" --region "$S3_REGION" ${S3_ENDPOINT:+--endpoint-url "$S3_ENDPOINT"}
+{{- else if .FTPURL}}
+	echo "Downloading $1"
+	# curl treats URL paths as relative to the login directory; %2F makes them absolute
+	case "$3" in
+	/*) p=%2F${3#/} ;;
+	*) p=$3 ;;
+	esac
+	curl -fsS{{if .FTPTLS}} --ssl-reqd{{end}} --user "$FTP_USER:$FTP_PASSWORD" -o "$1" "$FTP_URL/$p"
+{{- if .Encrypted}}
+	# decrypt reads the wrapped data keys from the file's key record
+	case "$1" in
+	*.enc) curl -fsS{{if .FTPTLS}} --ssl-reqd{{end}} --user "$FTP_USER:$FTP_PASSWORD" -o "$1.keys" "$FTP_URL/$p.keys" ;;
+	esac
+{{- end}}
+{{- else}}
+	echo "$1 not found; copy it{{if .Encrypted}} and its .keys file{{end}} from {{.BackupPath}} into this directory" >&2
+	exit 1
+{{- end}}
+}
+
+# stream writes the decrypted, decompressed contents of a backup file to stdout
+stream() {
+	f=$1
+	case "$f" in
+	*.enc)
+{{- if .Encrypted}}
+		"$DB_BACKUP" decrypt -path . -file "$f" -output "${f%.enc}" -encrypt-keys "$BACKUP_KEYS"{{if .S3Bucket}} \
+			-s3-bucket "$S3_BUCKET" -s3-region "$S3_REGION" -s3-endpoint "$S3_ENDPOINT" -s3-prefix {{sh .S3Prefix}}{{end}} >&2
+{{- end}}
+		f=${f%.enc} ;;
+	esac
+	case "$f" in
+	*.gz) gunzip -c "$f" ;;
+	*) cat "$f" ;;
+	esac
 }
+{{if eq .Engine "mysql"}}
+BT=$(printf '\140')
+db() {
+	mysql --host="$DB_HOST" --port="$DB_PORT" --user="$DB_ADMIN_USER" ${DB_ADMIN_PASSWORD:+--password="$DB_ADMIN_PASSWORD"} "$@"
+}
+
+echo "Creating database $DB_NAME"
+db -e "CREATE DATABASE IF NOT EXISTS ${BT}${DB_NAME}${BT}"
+if [ -n "$APP_USER" ]; then
+	echo "Granting access to $APP_USER"
+	if [ -n "$APP_PASSWORD" ]; then
+		db -e "CREATE USER IF NOT EXISTS '$APP_USER'@'%' IDENTIFIED BY '$APP_PASSWORD'"
+	fi
+	db -e "GRANT ALL PRIVILEGES ON ${BT}${DB_NAME}${BT}.* TO '$APP_USER'@'%'"
+fi
+{{range .Backup.Files}}{{if ne .Part "restore-script"}}
+echo "Loading {{.Name}}"
+fetch {{sh .Name}} {{sh .S3Key}} {{sh .FTPPath}}
+stream {{sh .Name}} | db "$DB_NAME"
+{{end}}{{end}}
+{{- else if eq .Engine "postgres"}}
+db() {
+	PGPASSWORD=$DB_ADMIN_PASSWORD psql --host="$DB_HOST" --port="$DB_PORT" --username="$DB_ADMIN_USER" -v ON_ERROR_STOP=1 --quiet "$@"
+}
+
+echo "Creating database $DB_NAME"
+if ! db --dbname=postgres -tAc "SELECT 1 FROM pg_database WHERE datname = '$DB_NAME'" | grep -q 1; then
+	db --dbname=postgres -c "CREATE DATABASE \"$DB_NAME\""
+fi
+if [ -n "$APP_USER" ]; then
+	echo "Granting access to $APP_USER"
+	if [ -n "$APP_PASSWORD" ] && ! db --dbname=postgres -tAc "SELECT 1 FROM pg_roles WHERE rolname = '$APP_USER'" | grep -q 1; then
+		db --dbname=postgres -c "CREATE ROLE \"$APP_USER\" LOGIN PASSWORD '$APP_PASSWORD'"
+	fi
+	db --dbname=postgres -c "GRANT ALL PRIVILEGES ON DATABASE \"$DB_NAME\" TO \"$APP_USER\""
+fi
+{{range .Backup.Files}}{{if ne .Part "restore-script"}}
+echo "Loading {{.Name}}"
+fetch {{sh .Name}} {{sh .S3Key}} {{sh .FTPPath}}
+stream {{sh .Name}} | db --dbname="$DB_NAME"
+{{end}}{{end}}
+{{- else}}{{range .Backup.Files}}{{if ne .Part "restore-script"}}
+fetch {{sh .Name}} {{sh .S3Key}} {{sh .FTPPath}}
+{{- if eq $.RedisFormat "logical"}}
+echo "Replaying {{.Name}} into $DB_HOST:$DB_PORT"
+stream {{sh .Name}} | REDISCLI_AUTH=$REDIS_PASSWORD redis-cli -h "$DB_HOST" -p "$DB_PORT" --pipe
+{{- else if eq $.RedisFormat "aof"}}
+mkdir -p redis-data
+stream {{sh .Name}} | tar -C redis-data -xf -
+echo "AOF extracted to ./redis-data. Stop Redis, copy its contents into the Redis data"
+echo "directory, fix ownership (chown -R redis:redis) and start Redis again."
+{{- else}}
+stream {{sh .Name}} > dump.rdb
+echo "Snapshot written to ./dump.rdb. Stop Redis, copy it over the dump.rdb in the Redis"
+echo "data directory, fix ownership (chown redis:redis) and start Redis again."
+{{- end}}
+{{end}}{{end}}{{end}}
+echo "Restore of {{.Backup.ID}} finished"
+`
 
 // Helper functions
 func getFileSize(path string) (int64, error) {
@@ -369,26 +3759,279 @@ func formatBytes(bytes int64) string {
 	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-func executeCommand(cmd string) error {
-	// Split the command to handle pipes properly
-	parts := strings.Fields(cmd)
-	if len(parts) == 0 {
+// runDump runs the dump tool in args and writes its output to outputPath,
+// gzip-compressed when compress is set. The tool runs without a shell so its
+// own exit status is checked; a pipeline into gzip would only report gzip's,
+// and a dump that died halfway would still leave an intact archive. On any
+// failure the output file is removed. env is added to the inherited
+// environment of the tool only, so managers with different credentials can
+// run side by side in one process.
+func runDump(outputPath string, compress bool, args, env []string) (err error) {
+	if len(args) == 0 {
 		return fmt.Errorf("empty command")
 	}
 
-	// For complex commands with pipes, we need to use shell
-	cmdObj := exec.Command("/bin/sh", "-c", cmd)
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %v", err)
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("failed to write backup file: %v", cerr)
+		}
+		if err != nil {
+			os.Remove(outputPath)
+		}
+	}()
+
+	var out io.Writer = file
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(file)
+		out = zw
+	}
 
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = out
 	// Capture stderr to help debug
-	cmdObj.Stderr = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("command failed: %s: %v", filepath.Base(args[0]), err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to write backup file: %v", err)
+		}
+	}
+	return nil
+}
+
+// labelNamePattern matches label names valid in Prometheus; it also keeps
+// them safe as S3 metadata header names and tag keys
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// labelValuePattern matches the characters S3 accepts in tag values
+var labelValuePattern = regexp.MustCompile(`^[a-zA-Z0-9 +\-=._:/@]*$`)
+
+// parseLabels parses a comma-separated list of key=value labels
+func parseLabels(value string) (map[string]string, error) {
+	items := splitList(value)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	// S3 allows at most 10 tags per object
+	if len(items) > 10 {
+		return nil, fmt.Errorf("too many labels: %d (at most 10)", len(items))
+	}
+	labels := make(map[string]string, len(items))
+	for _, item := range items {
+		k, v, ok := strings.Cut(item, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || !labelNamePattern.MatchString(k) || strings.HasPrefix(k, "__") {
+			return nil, fmt.Errorf("invalid label: %s", item)
+		}
+		if k == "connection" || k == "database" {
+			return nil, fmt.Errorf("label %s is reserved", k)
+		}
+		if len(v) > 256 {
+			return nil, fmt.Errorf("label %s value is longer than 256 characters", k)
+		}
+		if !labelValuePattern.MatchString(v) {
+			return nil, fmt.Errorf("label %s value may only contain letters, digits, spaces and + - = . _ : / @", k)
+		}
+		if _, dup := labels[k]; dup {
+			return nil, fmt.Errorf("duplicate label: %s", k)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// writeMetrics writes the managers' counters in the Prometheus text format.
+// Every series carries the connection, database and configured labels.
+func writeMetrics(w io.Writer, managers []*BackupManager) {
+	metrics := []struct {
+		name, kind, help string
+		value            func(*backupStats) float64
+	}{
+		{"backup_cycles_total", "counter", "Backup cycles run.",
+			func(s *backupStats) float64 { return float64(s.cycles.Load()) }},
+		{"backup_cycles_failed_total", "counter", "Backup cycles that failed.",
+			func(s *backupStats) float64 { return float64(s.cyclesFailed.Load()) }},
+		{"backup_bytes_total", "counter", "Bytes of backup files written.",
+			func(s *backupStats) float64 { return float64(s.bytes.Load()) }},
+		{"backup_files_in_flight", "gauge", "Backup files being dumped, compressed or uploaded.",
+			func(s *backupStats) float64 { return float64(s.inFlight.Load()) }},
+		{"backup_last_success_timestamp_seconds", "gauge", "Unix time of the last successful cycle.",
+			func(s *backupStats) float64 { return float64(s.lastSuccess.Load()) }},
+		{"backup_last_cycle_duration_seconds", "gauge", "Duration of the last cycle.",
+			func(s *backupStats) float64 { return time.Duration(s.lastCycle.Load()).Seconds() }},
+	}
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, bm := range managers {
+			labels := map[string]string{
+				"connection": bm.config.Connection,
+				"database":   bm.config.DBName,
+			}
+			maps.Copy(labels, bm.config.Labels)
+			var pairs []string
+			for _, k := range slices.Sorted(maps.Keys(labels)) {
+				pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, escape.Replace(labels[k])))
+			}
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, strings.Join(pairs, ","),
+				strconv.FormatFloat(m.value(&bm.stats), 'g', -1, 64))
+		}
+	}
+}
+
+// startDebugServer serves net/http/pprof profiles under /debug/pprof/ and
+// expvar statistics under /debug/vars on addr
+func startDebugServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return serveHTTP("Diagnostics", addr, mux)
+}
+
+// startMetricsServer serves the managers' Prometheus metrics under /metrics
+// on addr, apart from the diagnostics endpoint so scrapers never reach pprof
+func startMetricsServer(addr string, managers ...*BackupManager) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, managers)
+	})
+	return serveHTTP("Metrics", addr, mux)
+}
 
-	err := cmdObj.Run()
+// serveHTTP serves handler on addr in the background. The listener is opened
+// before returning so a bad address fails at startup.
+func serveHTTP(name, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		return fmt.Errorf("command failed: %v", err)
+		return fmt.Errorf("failed to start %s endpoint: %v", strings.ToLower(name), err)
 	}
+
+	log.Printf("%s endpoint listening on %s", name, listener.Addr())
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			log.Printf("%s endpoint stopped: %v", name, err)
+		}
+	}()
 	return nil
 }
 
+// hostOffset returns a deterministic offset within the interval derived from
+// the hostname, so a fleet of agents does not start its cycles in lockstep
+func hostOffset(interval time.Duration) time.Duration {
+	host, err := os.Hostname()
+	if err != nil || interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// parseJitter parses a jitter value given either as a percentage of the
+// interval (e.g. "10%") or as a duration (e.g. "30s")
+func parseJitter(value string, interval time.Duration) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if pct, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseFloat(pct, 64)
+		if err != nil || math.IsNaN(p) || math.IsInf(p, 0) || p < 0 || p >= 100 {
+			return 0, fmt.Errorf("invalid jitter percentage: %s", value)
+		}
+		return time.Duration(float64(interval) * p / 100), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid jitter duration: %s", value)
+	}
+	if d >= interval {
+		return 0, fmt.Errorf("jitter %v must be less than the interval %v", d, interval)
+	}
+	return d, nil
+}
+
+// commandOptions are the flags used by maintenance commands
+type commandOptions struct {
+	backupFile string
+	output     string
+	keyPattern string
+	backupIDs  []string
+	signKey    string
+	verifyKey  string
+}
+
+// runCommand executes a maintenance command selected on the command line
+func (bm *BackupManager) runCommand(command string, opts commandOptions) error {
+	switch command {
+	case "redis-restore":
+		if bm.config.Connection != "redis" {
+			return fmt.Errorf("redis-restore requires -connection=redis")
+		}
+		if opts.backupFile == "" {
+			return fmt.Errorf("redis-restore requires -file")
+		}
+		restored, err := bm.RestoreRedis(opts.backupFile, opts.keyPattern)
+		log.Printf("Restored %d key(s) matching %q from %s", restored, opts.keyPattern, filepath.Base(opts.backupFile))
+		return err
+	case "decrypt":
+		if opts.backupFile == "" {
+			return fmt.Errorf("decrypt requires -file")
+		}
+		return bm.DecryptBackup(opts.backupFile, opts.output)
+	case "rotate-keys":
+		rotated, err := bm.RotateKeys()
+		log.Printf("Re-wrapped data keys of %d encrypted file(s)", rotated)
+		return err
+	case "export":
+		if opts.output == "" {
+			return fmt.Errorf("export requires -output")
+		}
+		exported, err := bm.ExportBackups(opts.backupIDs, opts.output, opts.signKey)
+		if err == nil {
+			log.Printf("Exported %d backup(s) to %s", exported, opts.output)
+		}
+		return err
+	case "import":
+		if opts.backupFile == "" {
+			return fmt.Errorf("import requires -file")
+		}
+		imported, err := bm.ImportBackups(opts.backupFile, opts.verifyKey)
+		if err == nil {
+			log.Printf("Imported %d backup(s) from %s", imported, opts.backupFile)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -417,28 +4060,90 @@ func getEnvBool(key string, fallback bool) bool {
 func main() {
 	// Define command-line flags with environment variables as defaults
 	var (
-		connection = flag.String("connection", getEnv("DB_CONNECTION", "mariadb"), "Database connection to backup")
-		dbHost     = flag.String("db-host", getEnv("DB_HOST", "127.0.0.1"), "Database host")
-		dbPort     = flag.String("db-port", getEnv("DB_PORT", "3306"), "Database port")
-		dbName     = flag.String("db-name", getEnv("DB_NAME", ""), "Database name")
-		dbUser     = flag.String("db-user", getEnv("DB_USER", ""), "Database user")
-		dbPassword = flag.String("db-password", getEnv("DB_PASSWORD", ""), "Database password")
-		path       = flag.String("path", getEnv("BACKUP_PATH", "./backups"), "Backup storage path")
-		s3Bucket   = flag.String("s3-bucket", getEnv("S3_BUCKET", ""), "S3 bucket name for backup storage")
-		s3Region   = flag.String("s3-region", getEnv("S3_REGION", ""), "S3 region")
-		s3Endpoint = flag.String("s3-endpoint", getEnv("S3_ENDPOINT", ""), "S3 custom endpoint URL (for services like HETZNER)")
-		s3Prefix   = flag.String("s3-prefix", getEnv("S3_PREFIX", "backups/"), "S3 object prefix")
-		maxFiles   = flag.Int("max-files", getEnvInt("MAX_FILES", 10), "Maximum number of backup files to keep")
-		interval   = flag.Int("interval", getEnvInt("BACKUP_INTERVAL", 15), "Interval in seconds between backups (min 5 seconds)")
-		gzip       = flag.Bool("gzip", getEnvBool("GZIP_COMPRESSION", false), "Compress backup files with gzip")
-		optimize   = flag.Bool("optimize", getEnvBool("OPTIMIZE_BACKUP", false), "Optimize backup performance by limiting concurrent operations")
+		connection  = flag.String("connection", getEnv("DB_CONNECTION", "mariadb"), "Database connection to backup")
+		dbHost      = flag.String("db-host", getEnv("DB_HOST", "127.0.0.1"), "Database host")
+		dbPort      = flag.String("db-port", getEnv("DB_PORT", "3306"), "Database port")
+		dbName      = flag.String("db-name", getEnv("DB_NAME", ""), "Database name")
+		dbUser      = flag.String("db-user", getEnv("DB_USER", ""), "Database user")
+		dbPassword  = flag.String("db-password", getEnv("DB_PASSWORD", ""), "Database password")
+		dbSSLMode   = flag.String("db-sslmode", getEnv("DB_SSLMODE", "disable"), "PostgreSQL sslmode: disable, require, verify-ca or verify-full")
+		path        = flag.String("path", getEnv("BACKUP_PATH", "./backups"), "Backup storage path")
+		s3Bucket    = flag.String("s3-bucket", getEnv("S3_BUCKET", ""), "S3 bucket name for backup storage")
+		s3Region    = flag.String("s3-region", getEnv("S3_REGION", ""), "S3 region")
+		s3Endpoint  = flag.String("s3-endpoint", getEnv("S3_ENDPOINT", ""), "S3 custom endpoint URL (for services like HETZNER)")
+		s3Prefix    = flag.String("s3-prefix", getEnv("S3_PREFIX", "backups/"), "S3 object prefix")
+		s3Proxy     = flag.String("s3-proxy", getEnv("S3_PROXY", ""), "HTTP/HTTPS proxy URL for S3 requests (defaults to HTTPS_PROXY)")
+		s3CABundle  = flag.String("s3-ca-bundle", getEnv("S3_CA_BUNDLE", ""), "PEM file of additional CA certificates to trust for the S3 endpoint")
+		s3Timeout   = flag.String("s3-timeout", getEnv("S3_TIMEOUT", ""), "Timeout for each S3 request, including the upload body (e.g. 30m)")
+		s3Retry     = flag.String("s3-retry-mode", getEnv("S3_RETRY_MODE", ""), "AWS SDK retry mode: standard or adaptive")
+		s3Attempts  = flag.Int("s3-max-attempts", getEnvInt("S3_MAX_ATTEMPTS", 0), "Maximum attempts per S3 request, including the first (0 for the SDK default)")
+		ftpHost     = flag.String("ftp-host", getEnv("FTP_HOST", ""), "FTP/FTPS server to upload backups to")
+		ftpPort     = flag.String("ftp-port", getEnv("FTP_PORT", ""), "FTP port (defaults to 21, or 990 for implicit TLS)")
+		ftpUser     = flag.String("ftp-user", getEnv("FTP_USER", "anonymous"), "FTP user")
+		ftpPassword = flag.String("ftp-password", getEnv("FTP_PASSWORD", ""), "FTP password")
+		ftpDir      = flag.String("ftp-dir", getEnv("FTP_DIR", ""), "Remote directory, as a template (e.g. /archive/{{.Host}}/{{.Database}})")
+		ftpTLS      = flag.String("ftp-tls", getEnv("FTP_TLS", ""), "FTPS mode: explicit (AUTH TLS) or implicit")
+		ftpActive   = flag.Bool("ftp-active", getEnvBool("FTP_ACTIVE", false), "Use active (PORT) instead of passive data connections")
+		ftpCABundle = flag.String("ftp-ca-bundle", getEnv("FTP_CA_BUNDLE", ""), "PEM file of extra CA certificates to trust for FTPS")
+		ftpInsecure = flag.Bool("ftp-insecure", getEnvBool("FTP_INSECURE", false), "Skip FTPS certificate verification")
+		ftpTimeout  = flag.String("ftp-timeout", getEnv("FTP_TIMEOUT", "1m"), "Timeout for each FTP command and for stalled transfers")
+		maxFiles    = flag.Int("max-files", getEnvInt("MAX_FILES", 10), "Maximum number of backups to keep")
+		interval    = flag.Int("interval", getEnvInt("BACKUP_INTERVAL", 15), "Interval in seconds between backups (min 5 seconds)")
+		jitter      = flag.String("jitter", getEnv("BACKUP_JITTER", ""), "Random jitter applied to each interval, as a percentage (e.g. 10%) or duration (e.g. 30s)")
+		hostOffset  = flag.Bool("host-offset", getEnvBool("BACKUP_HOST_OFFSET", false), "Delay the first backup by a deterministic per-host offset within the interval")
+		gzip        = flag.Bool("gzip", getEnvBool("GZIP_COMPRESSION", false), "Compress backup files with gzip")
+		optimize    = flag.Bool("optimize", getEnvBool("OPTIMIZE_BACKUP", false), "Optimize backup performance by limiting concurrent operations")
+		schemaOnly  = flag.Bool("schema-only", getEnvBool("SCHEMA_ONLY", false), "Dump only the schema (mysqldump --no-data, pg_dump -s)")
+		dataOnly    = flag.Bool("data-only", getEnvBool("DATA_ONLY", false), "Dump only the data (mysqldump --no-create-info, pg_dump -a)")
+		splitDump   = flag.Bool("split-schema", getEnvBool("SPLIT_SCHEMA", false), "Write schema and data as separate files each cycle")
+		maxSchema   = flag.Int("max-schema-files", getEnvInt("MAX_SCHEMA_FILES", 0), "Maximum number of schema backups to keep (defaults to -max-files)")
+		perTable    = flag.Bool("per-table", getEnvBool("PER_TABLE", false), "Dump each table to its own file")
+		parallelism = flag.Int("parallel", getEnvInt("BACKUP_PARALLELISM", 4), "Number of files dumped, compressed and uploaded concurrently")
+		once        = flag.Bool("once", getEnvBool("BACKUP_ONCE", false), "Run a single backup cycle and exit with a status code describing the outcome")
+		redisFormat = flag.String("redis-format", getEnv("REDIS_FORMAT", "rdb"), "Redis backup format: rdb, aof or logical")
+		redisAOF    = flag.String("redis-aof-path", getEnv("REDIS_AOF_PATH", ""), "Path to appendonly.aof or appendonlydir for -redis-format=aof")
+		keyPattern  = flag.String("redis-key-pattern", getEnv("REDIS_KEY_PATTERN", "*"), "Key pattern for logical Redis backups and redis-restore")
+		restoreSh   = flag.Bool("restore-script", getEnvBool("RESTORE_SCRIPT", false), "Generate and upload a restore script alongside each backup")
+		restoreTmpl = flag.String("restore-script-template", getEnv("RESTORE_SCRIPT_TEMPLATE", ""), "Custom text/template file for -restore-script")
+		auditLog    = flag.String("audit-log", getEnv("AUDIT_LOG", ""), "Append-only audit log file recording deletions and restores")
+		auditS3     = flag.Bool("audit-s3", getEnvBool("AUDIT_S3", false), "Also write audit events to S3 under -audit-s3-prefix")
+		auditPrefix = flag.String("audit-s3-prefix", getEnv("AUDIT_S3_PREFIX", "audit/"), "S3 prefix for -audit-s3 events; must not overlap -s3-prefix")
+		encryptKeys = flag.String("encrypt-keys", getEnv("ENCRYPTION_KEYS", ""), "Comma-separated keys to encrypt backups for: file:<path> or kms:<key-id>")
+		retiredKeys = flag.String("retired-keys", getEnv("ENCRYPTION_RETIRED_KEYS", ""), "Comma-separated keys still accepted for decryption but no longer used to encrypt")
+		kmsRegion   = flag.String("kms-region", getEnv("KMS_REGION", ""), "AWS region for kms: keys (defaults to the AWS SDK configuration)")
+		backupFile  = flag.String("file", "", "Backup file or archive to operate on (redis-restore, decrypt, import)")
+		output      = flag.String("output", "", "Output file (decrypt, export)")
+		backupIDs   = flag.String("backups", "", "Comma-separated backup IDs to export (defaults to every backup in the manifest)")
+		signKey     = flag.String("sign-key", getEnv("EXPORT_SIGN_KEY", ""), "Ed25519 private key (PKCS#8 PEM) used to sign export archives")
+		verifyKey   = flag.String("verify-key", getEnv("IMPORT_VERIFY_KEY", ""), "Ed25519 public key (PEM) used to verify archives before import")
+		labels      = flag.String("labels", getEnv("LABELS", ""), "Comma-separated key=value labels for manifests, S3 tags and metrics (e.g. env=prod,team=payments)")
+		debugAddr   = flag.String("debug-addr", getEnv("DEBUG_ADDR", ""), "Serve pprof and expvar diagnostics on this address (e.g. localhost:6060)")
+		metricsAddr = flag.String("metrics-addr", getEnv("METRICS_ADDR", ""), "Serve Prometheus metrics on /metrics at this address (e.g. :9090)")
+		noPreflight = flag.Bool("skip-preflight", getEnvBool("SKIP_PREFLIGHT", false), "Skip startup validation of dump tools, credentials, backup path and S3 bucket")
 	)
 
+	// A leading non-flag argument selects a maintenance command instead of
+	// the backup loop
+	command := ""
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	flag.Parse()
 
+	switch command {
+	case "", "redis-restore", "decrypt", "rotate-keys", "export", "import":
+	default:
+		log.Fatalf("Unknown command: %s", command)
+	}
+
+	// Commands that only work on stored backups need no database
+	offline := command == "decrypt" || command == "rotate-keys" || command == "export" || command == "import"
+
 	// Validate required parameters
 	// For Redis, DBName and DBUser might not be required
-	if *connection != "redis" && (*dbName == "" || *dbUser == "" || *dbPassword == "") {
+	if !offline && *connection != "redis" && (*dbName == "" || *dbUser == "" || *dbPassword == "") {
 		log.Fatal("Database name, user, and password are required for SQL databases")
 	}
 
@@ -447,11 +4152,87 @@ func main() {
 		log.Fatal("Interval must be at least 5 seconds")
 	}
 
+	// Validate schema/data selection
+	if *schemaOnly || *dataOnly || *splitDump {
+		if *connection == "redis" {
+			log.Fatal("Schema and data selection is only supported for SQL databases")
+		}
+		if (*schemaOnly && *dataOnly) || (*splitDump && (*schemaOnly || *dataOnly)) {
+			log.Fatal("Only one of -schema-only, -data-only and -split-schema may be set")
+		}
+	}
+
+	// Validate per-table dumps
+	if *perTable && *connection == "redis" {
+		log.Fatal("Per-table dumps are only supported for SQL databases")
+	}
+	if *parallelism < 1 {
+		log.Fatal("Parallelism must be at least 1")
+	}
+
+	// Validate Redis format
+	switch *redisFormat {
+	case "rdb", "logical":
+	case "aof":
+		if *connection == "redis" && *redisAOF == "" {
+			log.Fatal("Redis AOF path is required for -redis-format=aof")
+		}
+	default:
+		log.Fatalf("Unsupported Redis format: %s", *redisFormat)
+	}
+
+	// Validate jitter
+	jitterDuration, err := parseJitter(*jitter, time.Duration(*interval)*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jobLabels, err := parseLabels(*labels)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// lib/pq does not support prefer or allow, so they are not offered
+	switch *dbSSLMode {
+	case "disable", "require", "verify-ca", "verify-full":
+	default:
+		log.Fatalf("Invalid -db-sslmode %q: use disable, require, verify-ca or verify-full", *dbSSLMode)
+	}
+
 	// Validate S3 configuration if S3 bucket is provided
 	if *s3Bucket != "" && *s3Region == "" {
 		log.Fatal("S3 region is required when using S3 storage")
 	}
 
+	if *auditS3 && *s3Bucket == "" {
+		log.Fatal("S3 bucket is required for -audit-s3")
+	}
+	if *auditS3 && *s3Prefix != "" && (strings.HasPrefix(*auditPrefix, *s3Prefix) || strings.HasPrefix(*s3Prefix, *auditPrefix)) {
+		log.Fatalf("-audit-s3-prefix %q must not overlap -s3-prefix %q", *auditPrefix, *s3Prefix)
+	}
+
+	// Validate S3 HTTP client settings
+	var s3TimeoutDuration time.Duration
+	if *s3Timeout != "" {
+		if s3TimeoutDuration, err = time.ParseDuration(*s3Timeout); err != nil || s3TimeoutDuration < 0 {
+			log.Fatalf("Invalid S3 timeout: %s", *s3Timeout)
+		}
+	}
+	if *s3Retry != "" {
+		if _, err := aws.ParseRetryMode(*s3Retry); err != nil {
+			log.Fatalf("Invalid S3 retry mode: %s", *s3Retry)
+		}
+	}
+
+	// Validate FTP settings
+	if *ftpTLS != "" && *ftpTLS != "explicit" && *ftpTLS != "implicit" {
+		log.Fatalf("Unsupported FTP TLS mode: %s", *ftpTLS)
+	}
+	ftpTimeoutDuration, err := time.ParseDuration(*ftpTimeout)
+	if err != nil || ftpTimeoutDuration <= 0 {
+		log.Fatalf("Invalid FTP timeout: %s", *ftpTimeout)
+	}
+
 	// Set default S3 endpoint if not provided but S3 is configured
 	if *s3Bucket != "" && *s3Endpoint == "" {
 		*s3Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", *s3Region)
@@ -465,30 +4246,123 @@ func main() {
 		DBName:     *dbName,
 		DBUser:     *dbUser,
 		DBPassword: *dbPassword,
+		DBSSLMode:  *dbSSLMode,
 		Path:       *path,
+		Labels:     jobLabels,
 		S3Bucket:   *s3Bucket,
 		S3Region:   *s3Region,
 		S3Endpoint: *s3Endpoint,
 		S3Prefix:   *s3Prefix,
+
+		S3AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		S3SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+
+		S3Proxy:       *s3Proxy,
+		S3CABundle:    *s3CABundle,
+		S3Timeout:     s3TimeoutDuration,
+		S3RetryMode:   *s3Retry,
+		S3MaxAttempts: *s3Attempts,
+
+		FTPHost:     *ftpHost,
+		FTPPort:     *ftpPort,
+		FTPUser:     *ftpUser,
+		FTPPassword: *ftpPassword,
+		FTPDir:      *ftpDir,
+		FTPTLS:      *ftpTLS,
+		FTPActive:   *ftpActive,
+		FTPCABundle: *ftpCABundle,
+		FTPInsecure: *ftpInsecure,
+		FTPTimeout:  ftpTimeoutDuration,
+
 		MaxFiles:   *maxFiles,
 		Interval:   time.Duration(*interval) * time.Second,
+		Jitter:     jitterDuration,
+		HostOffset: *hostOffset,
 		Gzip:       *gzip,
 		Optimize:   *optimize,
+
+		SchemaOnly:     *schemaOnly,
+		DataOnly:       *dataOnly,
+		SplitSchema:    *splitDump,
+		MaxSchemaFiles: *maxSchema,
+		PerTable:       *perTable,
+		Parallelism:    *parallelism,
+
+		RedisFormat:     *redisFormat,
+		RedisAOFPath:    *redisAOF,
+		RedisKeyPattern: *keyPattern,
+
+		EncryptionKeys: splitList(*encryptKeys),
+		RetiredKeys:    splitList(*retiredKeys),
+		KMSRegion:      *kmsRegion,
+		Offline:        offline,
+
+		RestoreScript:         *restoreSh || *restoreTmpl != "",
+		RestoreScriptTemplate: *restoreTmpl,
+
+		AuditLog:      *auditLog,
+		AuditS3:       *auditS3,
+		AuditS3Prefix: *auditPrefix,
 	}
 
 	// Create backup manager
 	bm, err := NewBackupManager(config)
 	if err != nil {
-		log.Fatalf("Failed to create backup manager: %v", err)
+		log.Printf("Failed to create backup manager: %v", err)
+		os.Exit(ExitCode(err))
+	}
+
+	// Maintenance commands work on existing backups and skip the backup loop
+	if command != "" {
+		opts := commandOptions{
+			backupFile: *backupFile,
+			output:     *output,
+			keyPattern: *keyPattern,
+			backupIDs:  splitList(*backupIDs),
+			signKey:    *signKey,
+			verifyKey:  *verifyKey,
+		}
+		if err := bm.runCommand(command, opts); err != nil {
+			log.Printf("%s failed: %v", command, err)
+			os.Exit(ExitCode(err))
+		}
+		return
+	}
+
+	// Diagnostics are opt-in; profiles expose internals, so bind to localhost
+	if *debugAddr != "" {
+		if err := startDebugServer(*debugAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *metricsAddr != "" {
+		if err := startMetricsServer(*metricsAddr, bm); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Fail fast on problems that would otherwise only surface in the first cycle
+	if !*noPreflight {
+		if err := bm.Preflight(); err != nil {
+			log.Printf("Startup validation failed: %v", err)
+			os.Exit(ExitCode(err))
+		}
+	}
+
+	// Start the backup process
+	if *once {
+		err = bm.RunOnce(0)
+	} else {
+		err = bm.Run()
 	}
 
 	// Only close DB if it was initialized
 	if bm.db != nil {
-		defer bm.db.Close()
+		bm.db.Close()
 	}
 
-	// Start the backup process
-	if err := bm.Run(); err != nil {
-		log.Fatalf("Backup process failed: %v", err)
+	if err != nil {
+		log.Printf("Backup process failed: %v", err)
+		os.Exit(ExitCode(err))
 	}
 }
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func writeTestKey(t *testing.T, dir, name string) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	dataKey := make([]byte, 32)
+	if _, err := crand.Read(dataKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, 2*encChunkSize + 5} {
+		plain := make([]byte, size)
+		if _, err := crand.Read(plain); err != nil {
+			t.Fatal(err)
+		}
+		src := filepath.Join(dir, "plain")
+		dst := filepath.Join(dir, "plain.enc")
+		if err := os.WriteFile(src, plain, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := encryptFile(src, dst, dataKey); err != nil {
+			t.Fatalf("size %d: encrypt: %v", size, err)
+		}
+		sealed, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if err := decryptStream(bytes.NewReader(sealed), &out, dataKey); err != nil {
+			t.Fatalf("size %d: decrypt: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+
+		// Dropping the final chunk must not pass for a shorter file
+		if size > encChunkSize {
+			truncated := sealed[:len(sealed)-(size%encChunkSize)-16]
+			if err := decryptStream(bytes.NewReader(truncated), &bytes.Buffer{}, dataKey); err == nil {
+				t.Fatalf("size %d: truncated ciphertext decrypted", size)
+			}
+		}
+
+		tampered := bytes.Clone(sealed)
+		tampered[len(tampered)-1] ^= 1
+		if err := decryptStream(bytes.NewReader(tampered), &bytes.Buffer{}, dataKey); err == nil {
+			t.Fatalf("size %d: tampered ciphertext decrypted", size)
+		}
+	}
+}
+
+func TestKeyringWrapUnwrap(t *testing.T) {
+	dir := t.TempDir()
+	current := "file:" + writeTestKey(t, dir, "current.key")
+	retired := "file:" + writeTestKey(t, dir, "retired.key")
+	other := "file:" + writeTestKey(t, dir, "other.key")
+
+	old, err := loadKeyring([]string{retired}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := make([]byte, 32)
+	if _, err := crand.Read(dataKey); err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := old.wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A retired key still unwraps
+	kr, err := loadKeyring([]string{current}, []string{retired}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := kr.unwrap(wrapped)
+	if err != nil {
+		t.Fatalf("unwrap with retired key: %v", err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Fatal("unwrapped data key mismatch")
+	}
+
+	stranger, err := loadKeyring([]string{other}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stranger.unwrap(wrapped); err == nil {
+		t.Fatal("unwrapped with a key the data key was not wrapped for")
+	}
+}
+
+func TestDecryptBackupFromKeyRecord(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := "file:" + writeTestKey(t, dir, "old.key")
+	newKey := "file:" + writeTestKey(t, dir, "new.key")
+	backups := filepath.Join(dir, "backups")
+	if err := os.Mkdir(backups, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	bm, err := NewBackupManager(&BackupConfig{Offline: true, Path: backups, EncryptionKeys: []string{oldKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 10000)
+	path := filepath.Join(backups, "backup_20260101_000000.sql")
+	if err := os.WriteFile(path, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bm.encryptArtifact(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".enc" + keyRecordSuffix); err != nil {
+		t.Fatalf("key record not written: %v", err)
+	}
+
+	// Rotate to the new key; no manifest exists, so only the record is used
+	bm, err = NewBackupManager(&BackupConfig{Offline: true, Path: backups, EncryptionKeys: []string{newKey}, RetiredKeys: []string{oldKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bm.RotateKeys(); err != nil || n != 1 {
+		t.Fatalf("RotateKeys = %d, %v; want 1, nil", n, err)
+	}
+
+	bm, err = NewBackupManager(&BackupConfig{Offline: true, Path: backups, EncryptionKeys: []string{newKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "restored.sql")
+	if err := bm.DecryptBackup(path+".enc", output); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("decrypted backup does not match the original")
+	}
+}
+
+func TestRedisGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "", true},
+		{"*", "user/1/name", true},
+		{"user/*", "user/1/name", true},
+		{"user:*", "user/1/name", false},
+		{"*/name", "user/1/name", true},
+		{"user/?/name", "user/1/name", true},
+		{"user/?/name", "user/12/name", false},
+		{"user?1", "user/1", true},
+		{"h?llo", "hello", true},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"[/]*", "/tmp/x", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`[\]]`, "]", true},
+		{"[abc", "b", true},
+		{"a**b", "a/x/b", true},
+		{"ab", "abc", false},
+	}
+	for _, tt := range tests {
+		if got := redisGlobMatch(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("redisGlobMatch(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels("env=prod, team=data-eng,owner=ops@example.com,path=a/b:c+d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels["team"] != "data-eng" || labels["owner"] != "ops@example.com" || labels["path"] != "a/b:c+d" {
+		t.Fatalf("unexpected labels: %v", labels)
+	}
+
+	for _, value := range []string{"team=a!b", "team=a#b", "team=café", "1team=x", "__x=y", "database=x", "env=a,env=b"} {
+		if _, err := parseLabels(value); err == nil {
+			t.Errorf("parseLabels(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestRunDump(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, compress := range []bool{false, true} {
+		output := filepath.Join(dir, "backup_test.sql")
+		if compress {
+			output += ".gz"
+		}
+
+		// A producer that dies halfway must fail and leave nothing behind,
+		// even though everything it wrote compresses to a valid archive
+		failing := []string{"sh", "-c", "echo 'CREATE TABLE t (id int);'; exit 3"}
+		if err := runDump(output, compress, failing, nil); err == nil {
+			t.Fatalf("compress=%v: failing dump succeeded", compress)
+		}
+		if _, err := os.Stat(output); !os.IsNotExist(err) {
+			t.Fatalf("compress=%v: failed dump left %s behind", compress, output)
+		}
+
+		working := []string{"sh", "-c", `echo "-- $SECRET"`}
+		if err := runDump(output, compress, working, []string{"SECRET=dump completed"}); err != nil {
+			t.Fatalf("compress=%v: %v", compress, err)
+		}
+		file, err := os.Open(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = file
+		if compress {
+			if r, err = gzip.NewReader(file); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := io.ReadAll(r)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "-- dump completed\n" {
+			t.Fatalf("compress=%v: got %q", compress, got)
+		}
+		if _, err := verifyBackup(output); err != nil {
+			t.Fatalf("compress=%v: %v", compress, err)
+		}
+	}
+}
+
+func TestParts(t *testing.T) {
+	tests := []struct {
+		config BackupConfig
+		want   []string
+	}{
+		{BackupConfig{Connection: "mysql"}, []string{""}},
+		{BackupConfig{Connection: "mysql", SplitSchema: true}, []string{"schema", "data"}},
+		{BackupConfig{Connection: "mysql", PerTable: true}, []string{"schema", "data"}},
+		{BackupConfig{Connection: "mysql", PerTable: true, DataOnly: true}, []string{"data"}},
+		{BackupConfig{Connection: "postgres", SplitSchema: true}, []string{"schema", "data"}},
+		{BackupConfig{Connection: "postgres", PerTable: true}, []string{"schema.pre-data", "data", "schema.post-data"}},
+		{BackupConfig{Connection: "postgres", PerTable: true, SchemaOnly: true}, []string{"schema"}},
+	}
+	for _, tt := range tests {
+		bm := &BackupManager{config: &tt.config}
+		if got := bm.parts(); !slices.Equal(got, tt.want) {
+			t.Errorf("parts(%+v) = %q, want %q", tt.config, got, tt.want)
+		}
+	}
+}
+
+// writeTestSigningKeys writes an Ed25519 key pair in the PEM forms openssl
+// produces and returns the private and public key paths
+func writeTestSigningKeys(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey := filepath.Join(dir, name+".pem")
+	verifyKey := filepath.Join(dir, name+".pub.pem")
+	if err := os.WriteFile(signKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(verifyKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return signKey, verifyKey
+}
+
+type tarEntry struct {
+	name string
+	data []byte
+}
+
+// rewriteExport copies the archive src to dst, passing its entries through
+// edit on the way
+func rewriteExport(t *testing.T, src, dst string, edit func([]tarEntry) []tarEntry) {
+	t.Helper()
+	file, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []tarEntry
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{hdr.Name, data})
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range edit(entries) {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	signKey, verifyKey := writeTestSigningKeys(t, dir, "site-a")
+	_, otherVerifyKey := writeTestSigningKeys(t, dir, "site-b")
+
+	source := filepath.Join(dir, "source")
+	if err := os.Mkdir(source, 0700); err != nil {
+		t.Fatal(err)
+	}
+	bm, err := NewBackupManager(&BackupConfig{Offline: true, Path: source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]byte{
+		"backup_20260101_000000.sql":        bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 1000),
+		"backup_20260101_000000.restore.sh": []byte("#!/bin/sh\n"),
+		"backup_20260102_000000.sql":        bytes.Repeat([]byte("INSERT INTO t VALUES (2);\n"), 1000),
+	}
+	manifest := &Manifest{}
+	for _, id := range []string{"backup_20260101_000000", "backup_20260102_000000"} {
+		backup := ManifestBackup{ID: id, Connection: "mysql", Database: "app"}
+		for _, name := range []string{id + ".sql", id + ".restore.sh"} {
+			data, ok := contents[name]
+			if !ok {
+				continue
+			}
+			if err := os.WriteFile(filepath.Join(source, name), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(data)
+			backup.Files = append(backup.Files, ManifestFile{Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+		}
+		manifest.Backups = append(manifest.Backups, backup)
+	}
+	if err := bm.saveManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, "export.tar")
+	if n, err := bm.ExportBackups(nil, archive, signKey); err != nil || n != 2 {
+		t.Fatalf("ExportBackups = %d, %v; want 2, nil", n, err)
+	}
+
+	tampered := map[string]func([]tarEntry) []tarEntry{
+		"flipped byte": func(entries []tarEntry) []tarEntry {
+			entries[3].data[len(entries[3].data)/2] ^= 1
+			return entries
+		},
+		"truncated": func(entries []tarEntry) []tarEntry {
+			return entries[:len(entries)-1]
+		},
+		"extra entry": func(entries []tarEntry) []tarEntry {
+			return append(entries, tarEntry{"backup_20260103_000000.sql", []byte("DROP TABLE t;\n")})
+		},
+		"duplicate entry": func(entries []tarEntry) []tarEntry {
+			return append(entries, entries[3])
+		},
+	}
+	for name, edit := range tampered {
+		bad := filepath.Join(dir, "bad.tar")
+		rewriteExport(t, archive, bad, edit)
+		target := filepath.Join(dir, "rejected")
+		ibm, err := NewBackupManager(&BackupConfig{Offline: true, Path: target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ibm.ImportBackups(bad, verifyKey); !errors.Is(err, ErrVerification) {
+			t.Errorf("%s: ImportBackups = %v, want ErrVerification", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(target, manifestName)); !os.IsNotExist(err) {
+			t.Errorf("%s: rejected archive wrote a manifest", name)
+		}
+	}
+
+	// A cut-off archive fails mid-stream rather than at an entry boundary
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := filepath.Join(dir, "cut.tar")
+	if err := os.WriteFile(cut, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "target")
+	ibm, err := NewBackupManager(&BackupConfig{Offline: true, Path: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []struct{ archive, key string }{{cut, verifyKey}, {archive, otherVerifyKey}} {
+		if _, err := ibm.ImportBackups(bad.archive, bad.key); !errors.Is(err, ErrVerification) {
+			t.Errorf("ImportBackups(%s, %s) = %v, want ErrVerification", filepath.Base(bad.archive), filepath.Base(bad.key), err)
+		}
+	}
+
+	if n, err := ibm.ImportBackups(archive, verifyKey); err != nil || n != 2 {
+		t.Fatalf("ImportBackups = %d, %v; want 2, nil", n, err)
+	}
+	for name, want := range contents {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs after import", name)
+		}
+	}
+	imported, err := ibm.loadManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Backups) != 2 || len(imported.Backups[0].Files) != 2 || imported.Backups[1].Database != "app" {
+		t.Fatalf("unexpected imported manifest: %+v", imported)
+	}
+
+	// Importing the same archive again skips the backups already present
+	if n, err := ibm.ImportBackups(archive, verifyKey); err != nil || n != 0 {
+		t.Fatalf("second ImportBackups = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestExpiredBackups(t *testing.T) {
+	const (
+		b1 = "backup_2026-01-01_00-00-00_000001"
+		b2 = "backup_2026-01-02_00-00-00_000002"
+		b3 = "backup_2026-01-03_00-00-00_000003"
+	)
+	perTable := func(id string) []string {
+		return []string{
+			id + ".schema.sql",
+			id + ".data.table.orders.sql.gz",
+			id + ".data.table.users.sql.gz",
+			id + ".restore.sh",
+		}
+	}
+	encrypted := func(id string) []string {
+		return []string{id + ".sql.gz.enc", id + ".sql.gz.enc.keys", id + ".restore.sh"}
+	}
+	var all []string
+	for _, id := range []string{b1, b2, b3} {
+		all = append(all, perTable(id)...)
+	}
+
+	tests := []struct {
+		name                     string
+		maxFiles, maxSchemaFiles int
+		names                    []string
+		want                     []string
+	}{
+		{
+			name:     "per-table groups expire whole",
+			maxFiles: 2, maxSchemaFiles: 3,
+			names: all,
+			want:  []string{b1 + ".data.table.orders.sql.gz", b1 + ".data.table.users.sql.gz", b1 + ".restore.sh"},
+		},
+		{
+			name:     "schema files count against -max-schema-files",
+			maxFiles: 3, maxSchemaFiles: 1,
+			names: all,
+			want:  []string{b1 + ".schema.sql", b2 + ".schema.sql"},
+		},
+		{
+			name:     "schema files default to -max-files",
+			maxFiles: 2,
+			names:    all,
+			want:     append(perTable(b1)[1:], b1+".schema.sql"),
+		},
+		{
+			name:     "key records and restore scripts expire with their backup",
+			maxFiles: 1,
+			names:    append(encrypted(b1), encrypted(b2)...),
+			want:     encrypted(b1),
+		},
+		{
+			name:     "within limits",
+			maxFiles: 3,
+			names:    all,
+		},
+	}
+	for _, tt := range tests {
+		bm := &BackupManager{config: &BackupConfig{MaxFiles: tt.maxFiles, MaxSchemaFiles: tt.maxSchemaFiles}}
+		got := bm.expiredBackups(tt.names)
+		slices.Sort(got)
+		want := slices.Clone(tt.want)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: expiredBackups = %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestParseJitter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, true},
+		{"0%", 0, true},
+		{"10%", 6 * time.Minute, true},
+		{" 2.5% ", 90 * time.Second, true},
+		{"5m", 5 * time.Minute, true},
+		{"100%", 0, false},
+		{"-1%", 0, false},
+		{"NaN%", 0, false},
+		{"nan%", 0, false},
+		{"Inf%", 0, false},
+		{"-Inf%", 0, false},
+		{"abc%", 0, false},
+		{"-5m", 0, false},
+		{"1h", 0, false},
+		{"5", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseJitter(tt.value, time.Hour)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("parseJitter(%q) = %v, %v; want %v", tt.value, got, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("parseJitter(%q) = %v, want an error", tt.value, got)
+		}
+	}
+}